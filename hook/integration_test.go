@@ -0,0 +1,88 @@
+//go:build integration
+// +build integration
+
+/* Copyright(C) 2022. Huawei Technologies Co.,Ltd. All rights reserved.
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package main
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestHookWithRuncBundle runs the built hook against a bundle generated by runc,
+// the state is passed through stdin the same way as the runtime does
+func TestHookWithRuncBundle(t *testing.T) {
+	if _, err := exec.LookPath("runc"); err != nil {
+		t.Skip("runc is not installed")
+	}
+	workDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("get work dir failed: %v", err)
+	}
+	// the bundle should be under a dir which passes the owner and permission checks, /tmp does not
+	bundle, err := os.MkdirTemp(workDir, "bundle")
+	if err != nil {
+		t.Fatalf("create bundle failed: %v", err)
+	}
+	defer os.RemoveAll(bundle)
+	if err := os.Chmod(bundle, 0750); err != nil {
+		t.Fatalf("chmod bundle failed: %v", err)
+	}
+
+	spec := exec.Command("runc", "spec", "--bundle", bundle)
+	if output, err := spec.CombinedOutput(); err != nil {
+		t.Fatalf("runc spec failed: %v, %s", err, output)
+	}
+	if err := os.Chmod(filepath.Join(bundle, "config.json"), 0640); err != nil {
+		t.Fatalf("chmod config failed: %v", err)
+	}
+
+	hook := filepath.Join(bundle, "ascend-kata-hook")
+	build := exec.Command("go", "build", "-o", hook, ".")
+	if output, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("build hook failed: %v, %s", err, output)
+	}
+
+	const pid = 1
+	state := fmt.Sprintf(`{"ociVersion":"1.0.2","id":"integration","status":"creating","pid":%d,"bundle":"%s"}`,
+		pid, bundle)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(hook, "-dump")
+	cmd.Stdin = bytes.NewBufferString(state)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run hook failed: %v, %s", err, stderr.String())
+	}
+
+	// only the first JSON value is the dump, the log mode cleanup may print after it
+	cfg := new(hookConfig)
+	if err := json.NewDecoder(bytes.NewReader(stdout.Bytes())).Decode(cfg); err != nil {
+		t.Fatalf("parse hook output failed: %v, %s", err, stdout.String())
+	}
+	// runc spec uses the relative rootfs, which should be resolved against the bundle
+	if cfg.Rootfs != filepath.Join(bundle, "rootfs") || cfg.Pid != pid {
+		t.Errorf("unexpected hook config %+v", cfg)
+	}
+	if cfg.Enabled {
+		t.Errorf("hook should do nothing without %s", ascendVisibleDevices)
+	}
+}
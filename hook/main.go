@@ -23,19 +23,28 @@ import (
 
 	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"huawei.com/npu-exporter/v5/common-utils/hwlog"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/syslog"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -44,37 +53,303 @@ import (
 
 const (
 	loggingPrefix          = "Ascend-kata-hook"
+	hookName               = "ascend-kata-hook"
 	runLogPath             = "/tmp/hook-run.log"
 	ascendRuntimeOptions   = "ASCEND_RUNTIME_OPTIONS"
 	ascendRuntimeMounts    = "ASCEND_RUNTIME_MOUNTS"
 	ascendVisibleDevices   = "ASCEND_VISIBLE_DEVICES"
 	ascendAllowLink        = "ASCEND_ALLOW_LINK"
+	ascendEnvPrefix        = "ASCEND_ENV_PREFIX"
+	ascendHookDisable      = "ASCEND_HOOK_DISABLE"
+	ascendConfigDir        = "ASCEND_CONTAINER_CONFIG_DIR"
+	ascendHookNoDeprecated = "ASCEND_HOOK_NO_DEPRECATION_WARNINGS"
+	ascendHookRepanic      = "ASCEND_HOOK_REPANIC"
+	hookDisabledFile       = "hook.disabled"
+	hookDefaultsFile       = "hook.conf"
+	envAliasFile           = "env-aliases.conf"
+	logLevelKey            = "log-level"
+	logMinFreeKey          = "log-min-free-mb"
 	ascendDockerCli        = "ascend-docker-cli"
 	defaultAscendDockerCli = "/usr/local/bin/ascend-docker-cli"
 	configDir              = "/etc/ascend-docker-runtime.d"
 	baseConfig             = "base"
+	allConfigs             = "*"
+	optionalConfigPrefix   = "?"
 	configFileSuffix       = "list"
+	combinedConfigFile     = "mounts.conf"
+	hostDevDir             = "/dev"
+	ascendDriverDir        = "/usr/local/Ascend/driver"
+	ascendInstallInfo      = "/etc/ascend_install.info"
+	driverInstallPathKey   = "Driver_Install_Path_Param"
+	driverLibDir           = "lib64"
+	driverVersionFile      = "version.info"
+	driverVersionKey       = "Version"
+	mountRecordFile        = "/etc/ascend-kata-hook/mounts.json"
+	setupReportFile        = "/var/log/ascend-setup.txt"
+	traceParentEnv         = "TRACEPARENT"
+	guestHookType          = "prestart"
 
 	kvPairSize       = 2
 	maxCommandLength = 65535
+	maxEntryNumber   = 128
+	maxMountConfigs  = 16
+	// a few hundred mounts cover all the driver files, the default only stops a runaway config
+	defaultMaxMounts = 1024
+	oneMegabyte      = 1024 * 1024
+	// the output files hold host paths and devices, they are at most readable by others
+	defaultOutputMode = 0600
+	maxOutputMode     = 0644
+	// the files copied into the container are config files, anything bigger should be mounted
+	maxCopySize = oneMegabyte
+	copyMode    = "copy"
+	// the device nodes listed in a mount config are created in the container instead of being mounted
+	deviceMode = "device"
+	// the flag values are paths, numbers, durations and comma separated lists of them
+	flagValueWhiteList = mindxcheckutils.DefaultWhiteList + ","
+	// real OCI state is well below 1KB, 64KB leaves plenty of room
+	defaultMaxStateSize = 64 * 1024
+	// /dev of a node has hundreds of entries, the limits only stop a misbehaving node
+	defaultDevScanTimeout    = 10 * time.Second
+	defaultDevScanMaxEntries = 65536
+	// the config dir is only waited for when the node is being provisioned, which should not hold a container long
+	maxConfigDirWait    = 2 * time.Minute
+	configDirWaitPeriod = 200 * time.Millisecond
+	// the setup of a container takes seconds, the lock is retried often enough not to add much to it
+	defaultLockTimeout = 30 * time.Second
+	lockRetryPeriod    = 100 * time.Millisecond
+	// a panic exits with its own code, so that it is told apart from the failures exiting with 1
+	panicExitCode = 2
+
+	// how the driver version of the mounts and the cwd of the container are checked
+	versionCheckOff   = "off"
+	versionCheckWarn  = "warn"
+	versionCheckError = "error"
+
+	// the probes a mount entry can require
+	probeExists = "exists"
+	probeModule = "module"
+
+	// how the symlinks in mount configs are handled
+	symlinkFollow  = "follow"
+	symlinkResolve = "resolve"
+	symlinkReject  = "reject"
+
+	// how the unknown options in ASCEND_RUNTIME_OPTIONS are handled
+	unknownOptionsStrict      = "strict"
+	unknownOptionsLenient     = "lenient"
+	unknownOptionsPassthrough = "passthrough"
+
+	// which configs are used when ASCEND_RUNTIME_MOUNTS is set to empty
+	emptyMountsBase = "base"
+	emptyMountsNone = "none"
+
+	// what is done when the container would get neither mount nor davinci device
+	emptySetupProceed = "proceed"
+	emptySetupSkip    = "skip"
+	emptySetupError   = "error"
+
+	// the deprecated behaviors warned by warnDeprecated
+	deprecatedImplicitBase  = "implicit-base"
+	deprecatedMountsCase    = "mounts-case"
+	deprecatedLongMounts    = "long-mounts"
+	deprecatedEnvAliasUsage = "env-alias"
+
+	// levels of the run log, same as hwlog
+	debugLevel = -1
+	infoLevel  = 0
+	warnLevel  = 1
+	errorLevel = 2
+	syslogTag  = "ascend-docker-hook"
 )
 
 var (
 	containerConfigInputStream = os.Stdin
+	flagOutput                 = io.Writer(os.Stderr)
 	doExec                     = syscall.Exec
+	exitHook                   = os.Exit
+	doMount                    = unix.Mount
+	checkRealFile              = mindxcheckutils.RealFileChecker
 	ascendDockerCliName        = ascendDockerCli
 	defaultAscendDockerCliName = defaultAscendDockerCli
+	maxStateSize               = int64(defaultMaxStateSize)
+	runLogLevel                = infoLevel
+	skipWithoutNpu             = false
+	dumpMode                   = false
+	stateFilePath              = ""
+	replayStatePath            = ""
+	validateConfigPath         = ""
+	generateConfig             = false
+	mountSymlinkMode           = symlinkFollow
+	emptyMountsMode            = emptyMountsBase
+	useSyslog                  = false
+	recordMounts               = false
+	setupReport                = false
+	maxDevices                 = 0
+	rejectConfigDirLink        = false
+	configDirWait              = time.Duration(0)
+	goArch                     = runtime.GOARCH
+	lockPath                   = ""
+	lockTimeout                = defaultLockTimeout
+	hookTimeout                = time.Duration(0)
+	strictEnv                  = false
+	requireAscend              = false
+	sortRuntimeOptions         = false
+	unknownOptionsMode         = unknownOptionsStrict
+	maxMounts                  = defaultMaxMounts
+	deprecationsWarned         = map[string]struct{}{}
+	outputFileMode             = os.FileMode(defaultOutputMode)
+	notifyPath                 = ""
+	tracePath                  = ""
+	tracer                     = (*hookTracer)(nil)
+	useSpecDevices             = false
+	mountsOnly                 = false
+	emptySetupMode             = emptySetupProceed
+	strictMounts               = false
+	devScanTimeout             = defaultDevScanTimeout
+	devScanMaxEntries          = defaultDevScanMaxEntries
+	sysModulePath              = "/sys/module"
+	deviceMajors               = map[int64]struct{}{}
+	hookDefaultsPath           = filepath.Join(configDir, hookDefaultsFile)
+	hookDefaults               = map[string]string{}
+	driverVersionCheck         = versionCheckOff
+	cwdCheck                   = versionCheckOff
+	mountConfigDir             = configDir
+	mountDriverLibs            = false
+	ascendInstallInfoPath      = ascendInstallInfo
+	envPrefix                  = ""
+	deviceGroup                = ""
+	hostDevPath                = hostDevDir
+	ascendDriverPath           = ascendDriverDir
 )
 
+// containerEnvNames are all the variables of the container the hook reads, which is what a container can
+// use to influence the hook. the ascend ones can also be read with the prefix given by ASCEND_ENV_PREFIX
+var containerEnvNames = []string{
+	ascendVisibleDevices,
+	ascendRuntimeOptions,
+	ascendRuntimeMounts,
+	ascendEnvPrefix,
+	ascendHookDisable,
+	ascendConfigDir,
+}
+
+// allowedEnvNames are the container variables the hook reads, -env-allowlist narrows them down
+var allowedEnvNames = makeEnvNameSet(containerEnvNames)
+
+// allowedConfigDirs are the config dirs a container can choose by ASCEND_CONTAINER_CONFIG_DIR instead of the
+// config dir of the node, no container can choose one when it is empty
+var allowedConfigDirs = []string{}
+
+// envAliases maps the canonical variables to their legacy names, which are loaded from env-aliases.conf
+// in the config dir and still read during migrations
+var envAliases = map[string][]string{}
+
+// generatedDriverPaths are the paths under the driver dir suggested by -generate-config, and generatedNodePaths
+// are the other paths of the driver install, the same as the base.list shipped with the hook
+var (
+	generatedDriverPaths = []string{driverLibDir, "include"}
+	generatedNodePaths   = []string{"/usr/local/dcmi", "/usr/local/bin/npu-smi"}
+)
+
+// bundleConfigPaths are where config.json is looked for relative to the bundle, the first is the standard one
+var bundleConfigPaths = []string{"config.json", "../config.json"}
+
+// configArchs are the architectures a mount config can be qualified with, named as GOARCH
+var configArchs = [...]string{"amd64", "arm64"}
+
 var validRuntimeOptions = [...]string{
 	"NODRV",
 	"VIRTUAL",
 }
 
+// runtimeOptionParams are the runtime options which can take a parameter as <option>=<parameter>,
+// with the check of the parameter
+var runtimeOptionParams = map[string]func(string) bool{
+	"VIRTUAL": isVirtualTemplateValid,
+}
+
+var errSymlinkRejected = errors.New("symlink is rejected")
+
+var errWrongType = errors.New("neither a regular file nor a dir")
+
+// the reasons a mount entry is skipped, logged as reason=<code> so that the logs of the nodes can be counted
+const (
+	skipNotFound        = "not-found"
+	skipPermission      = "permission-denied"
+	skipWrongType       = "wrong-type"
+	skipConditionNotMet = "condition-not-met"
+	skipProbeFailed     = "probe-failed"
+	skipDuplicated      = "duplicated"
+	skipOtherError      = "other-error"
+)
+
+const defaultDeviceManagers = "davinci_manager,hisi_hdc,devmm_svm"
+
+// deviceManagerNames are the control-plane device nodes created besides the davinci devices
+var deviceManagerNames = strings.Split(defaultDeviceManagers, ",")
+
+// mountPropagations are the propagation modes which could follow a path in the mount config
+var mountPropagations = map[string]uintptr{
+	"private":  unix.MS_PRIVATE,
+	"rprivate": unix.MS_PRIVATE | unix.MS_REC,
+	"shared":   unix.MS_SHARED,
+	"rshared":  unix.MS_SHARED | unix.MS_REC,
+	"slave":    unix.MS_SLAVE,
+	"rslave":   unix.MS_SLAVE | unix.MS_REC,
+}
+
 type containerConfig struct {
-	Pid    int
-	Rootfs string
-	Env    []string
+	Pid       int
+	Rootfs    string
+	Env       []string
+	ID        string
+	SandboxID string
+	// Cwd is the working dir of the container process in the rootfs
+	Cwd string
+	// DeviceRules are the device cgroup rules of the spec, which a device plugin may use instead of env
+	DeviceRules []specs.LinuxDeviceCgroup
+}
+
+// containerState is the OCI state with the fields some CRI shims add, unknown fields are ignored
+type containerState struct {
+	specs.State
+	SandboxID string `json:"sandboxId,omitempty"`
+}
+
+// mountEntry is a host path read from the mount config with its mount options
+type mountEntry struct {
+	Path        string `json:"path"`
+	Propagation string `json:"propagation,omitempty"`
+	// Condition is the runtime option required by the entry, the entry always applies when it is empty
+	Condition string `json:"condition,omitempty"`
+	// Exclude marks the path left out of the dir mount containing it
+	Exclude bool `json:"exclude,omitempty"`
+	// Probe is the check of the node required by the entry, such as exists:/dev/devmm_svm
+	Probe string `json:"probe,omitempty"`
+	// Copy marks the small file copied into the container instead of being bind mounted
+	Copy bool `json:"copy,omitempty"`
+	// Device marks the character device node created in the container instead of being bind mounted
+	Device bool `json:"device,omitempty"`
+}
+
+// hookConfig is the effective configuration resolved by the hook for a container
+type hookConfig struct {
+	Enabled        bool              `json:"enabled"`
+	ContainerID    string            `json:"containerId"`
+	SandboxID      string            `json:"sandboxId,omitempty"`
+	Pid            int               `json:"pid"`
+	Rootfs         string            `json:"rootfs"`
+	Env            map[string]string `json:"env"`
+	RuntimeOptions []string          `json:"runtimeOptions"`
+	ConfigDir      string            `json:"configDir"`
+	MountConfigs   []string          `json:"mountConfigs"`
+	FileMounts     []mountEntry      `json:"fileMounts"`
+	DirMounts      []mountEntry      `json:"dirMounts"`
+	Devices        []string          `json:"devices"`
+	// DeviceGid is the group of the device nodes created in the container, -1 keeps the default group
+	DeviceGid int `json:"deviceGid"`
+	// MountsOnly is set when the container requests mounts without devices, no device node is created
+	MountsOnly bool `json:"mountsOnly,omitempty"`
 }
 
 func initLogModule(ctx context.Context) error {
@@ -82,7 +357,7 @@ func initLogModule(ctx context.Context) error {
 	const logMaxAge = 365
 	runLogConfig := hwlog.LogConfig{
 		LogFileName: runLogPath,
-		LogLevel:    0,
+		LogLevel:    runLogLevel,
 		MaxBackups:  backups,
 		MaxAge:      logMaxAge,
 		OnlyToFile:  true,
@@ -95,23 +370,151 @@ func initLogModule(ctx context.Context) error {
 	return nil
 }
 
-func parseMounts(mounts string) []string {
+// hookLogger writes the run log by hwlog, and also to syslog when syslog is enabled
+type hookLogger struct {
+	syslogWriter *syslog.Writer
+	// fallback takes the run log instead of the log file when the file is not written
+	fallback io.Writer
+}
+
+var hookLog = &hookLogger{}
+
+// initSyslog makes the run log also written to syslog, the log is kept in files only when syslog is unavailable
+func initSyslog() {
+	writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, syslogTag)
+	if err != nil {
+		hookLog.Warnf("Ascend-kata-hook: syslog is unavailable, log to file only: %v", err)
+		return
+	}
+	hookLog.syslogWriter = writer
+}
+
+// Debugf writes the debug log
+func (l *hookLogger) Debugf(format string, args ...interface{}) {
+	if !l.toFallback(debugLevel, format, args...) {
+		hwlog.RunLog.Debugf(format, args...)
+	}
+	l.toSyslog(debugLevel, format, args...)
+}
+
+// Infof writes the info log
+func (l *hookLogger) Infof(format string, args ...interface{}) {
+	if !l.toFallback(infoLevel, format, args...) {
+		hwlog.RunLog.Infof(format, args...)
+	}
+	l.toSyslog(infoLevel, format, args...)
+}
+
+// Warnf writes the warning log
+func (l *hookLogger) Warnf(format string, args ...interface{}) {
+	if !l.toFallback(warnLevel, format, args...) {
+		hwlog.RunLog.Warnf(format, args...)
+	}
+	l.toSyslog(warnLevel, format, args...)
+}
+
+// Errorf writes the error log
+func (l *hookLogger) Errorf(format string, args ...interface{}) {
+	if !l.toFallback(errorLevel, format, args...) {
+		hwlog.RunLog.Errorf(format, args...)
+	}
+	l.toSyslog(errorLevel, format, args...)
+}
+
+func (l *hookLogger) toSyslog(level int, format string, args ...interface{}) {
+	if l.syslogWriter == nil || level < runLogLevel {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	var err error
+	switch level {
+	case debugLevel:
+		err = l.syslogWriter.Debug(msg)
+	case infoLevel:
+		err = l.syslogWriter.Info(msg)
+	case warnLevel:
+		err = l.syslogWriter.Warning(msg)
+	default:
+		err = l.syslogWriter.Err(msg)
+	}
+	if err != nil && !l.toFallback(warnLevel, "Ascend-kata-hook: write syslog failed: %v", err) {
+		hwlog.RunLog.Warnf("Ascend-kata-hook: write syslog failed: %v", err)
+	}
+}
+
+// toFallback writes the run log to the fallback writer, false is returned when the log file is used instead
+func (l *hookLogger) toFallback(level int, format string, args ...interface{}) bool {
+	if l.fallback == nil {
+		return false
+	}
+	if level < runLogLevel {
+		return true
+	}
+	names := map[int]string{debugLevel: "DEBUG", infoLevel: "INFO", warnLevel: "WARN", errorLevel: "ERROR"}
+	fmt.Fprintf(l.fallback, "[%s] %s %s\n", names[level], time.Now().Format(time.RFC3339), fmt.Sprintf(format, args...))
+	return true
+}
+
+// checkLogSpace makes sure at least minFree bytes are available in the dir of the run log, so that a full disk
+// does not make the log writes fail in the middle of the setup
+func checkLogSpace(dir string, minFree int64) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return fmt.Errorf("statfs %s failed: %v", dir, err)
+	}
+	if free := int64(stat.Bavail) * int64(stat.Bsize); free < minFree {
+		return fmt.Errorf("%d bytes available in %s, less than %d bytes", free, dir, minFree)
+	}
+	return nil
+}
+
+// parseMounts parses ASCEND_RUNTIME_MOUNTS, the base config is used when it is unset.
+// when it is set to empty, no config or the base config is used according to the empty mounts mode
+func parseMounts(mounts string, isSet bool) ([]string, error) {
+	if !isSet {
+		warnDeprecated(deprecatedImplicitBase, "%s is unset and %s is used implicitly, set %s=%s explicitly",
+			ascendRuntimeMounts, baseConfig, ascendRuntimeMounts, baseConfig)
+		return []string{baseConfig}, nil
+	}
 	if mounts == "" {
-		return []string{baseConfig}
+		if emptyMountsMode == emptyMountsNone {
+			return []string{}, nil
+		}
+		warnDeprecated(deprecatedImplicitBase, "%s is empty and %s is used implicitly, set %s=%s explicitly",
+			ascendRuntimeMounts, baseConfig, ascendRuntimeMounts, baseConfig)
+		return []string{baseConfig}, nil
 	}
 	const maxMountLength = 128
 	if len(mounts) > maxMountLength {
-		return []string{baseConfig}
+		warnDeprecated(deprecatedLongMounts, "%s is longer than %d chars and %s is used instead, "+
+			"which will be an error", ascendRuntimeMounts, maxMountLength, baseConfig)
+		return []string{baseConfig}, nil
 	}
 
-	mountConfigs := make([]string, 0)
-	for _, m := range strings.Split(mounts, ",") {
+	names := strings.Split(mounts, ",")
+	if len(names) > maxMountConfigs {
+		return nil, fmt.Errorf("%d mount configs are requested, at most %d are allowed", len(names), maxMountConfigs)
+	}
+	mountConfigs := make([]string, 0, len(names))
+	for _, m := range names {
 		m = strings.TrimSpace(m)
-		m = strings.ToLower(m)
+		if lower := strings.ToLower(m); lower != m {
+			warnDeprecated(deprecatedMountsCase, "mount config %s is lowercased to %s, use the lowercase name",
+				m, lower)
+			m = lower
+		}
+		if !isMountConfigNameValid(strings.TrimPrefix(m, optionalConfigPrefix)) {
+			return nil, fmt.Errorf("invalid mount config name %q", m)
+		}
 		mountConfigs = append(mountConfigs, m)
 	}
 
-	return mountConfigs
+	return mountConfigs, nil
+}
+
+// isMountConfigNameValid makes sure the config name can only refer to a file directly under the config dir
+func isMountConfigNameValid(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\`) && !strings.Contains(name, "..")
 }
 
 func isRuntimeOptionValid(option string) bool {
@@ -124,6 +527,55 @@ func isRuntimeOptionValid(option string) bool {
 	return false
 }
 
+// isVirtualTemplateValid checks the vNPU template of the VIRTUAL option, which is vir<2 digits> followed by
+// the optional _<n>c, _dvpp and _ndvpp parts, e.g. vir04, vir02_1c, vir04_3c_ndvpp
+func isVirtualTemplateValid(template string) bool {
+	const ratioDigits = 2
+	parts := strings.Split(template, "_")
+	ratio := strings.TrimPrefix(parts[0], "vir")
+	if ratio == parts[0] || len(ratio) != ratioDigits || !isDigits(ratio) {
+		return false
+	}
+	for _, part := range parts[1:] {
+		if part == "dvpp" || part == "ndvpp" {
+			continue
+		}
+		if cores := strings.TrimSuffix(part, "c"); cores == part || !isDigits(cores) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// runtimeOptionName is the option without its parameter
+func runtimeOptionName(option string) string {
+	name, _, _ := strings.Cut(option, "=")
+	return name
+}
+
+// sortOptions sorts the runtime options into the order of validRuntimeOptions, the same option with different
+// parameters is sorted by the parameter
+func sortOptions(options []string) {
+	rank := func(option string) int {
+		for i, validOption := range validRuntimeOptions {
+			if runtimeOptionName(option) == validOption {
+				return i
+			}
+		}
+		return len(validRuntimeOptions)
+	}
+	sort.SliceStable(options, func(i, j int) bool {
+		if rank(options[i]) != rank(options[j]) {
+			return rank(options[i]) < rank(options[j])
+		}
+		return options[i] < options[j]
+	})
+}
+
 func parseRuntimeOptions(runtimeOptions string) ([]string, error) {
 	parsedOptions := make([]string, 0)
 
@@ -137,8 +589,21 @@ func parseRuntimeOptions(runtimeOptions string) ([]string, error) {
 
 	for _, option := range strings.Split(runtimeOptions, ",") {
 		option = strings.TrimSpace(option)
-		if !isRuntimeOptionValid(option) {
-			return nil, fmt.Errorf("invalid runtime option")
+		name, param, hasParam := strings.Cut(option, "=")
+		if !isRuntimeOptionValid(name) {
+			keep, err := handleUnknownOption(option)
+			if err != nil {
+				return nil, err
+			}
+			if keep {
+				parsedOptions = append(parsedOptions, option)
+			}
+			continue
+		}
+		if hasParam {
+			if checkParam, ok := runtimeOptionParams[name]; !ok || !checkParam(param) {
+				return nil, fmt.Errorf("invalid parameter of runtime option %s", name)
+			}
 		}
 
 		parsedOptions = append(parsedOptions, option)
@@ -147,6 +612,73 @@ func parseRuntimeOptions(runtimeOptions string) ([]string, error) {
 	return parsedOptions, nil
 }
 
+// handleUnknownOption handles the option the hook does not know by the unknown options mode, true is returned
+// when the option is kept in the parsed options. the kept options have no effect on the setup
+func handleUnknownOption(option string) (bool, error) {
+	switch unknownOptionsMode {
+	case unknownOptionsLenient:
+		hookLog.Warnf("Ascend-kata-hook: drop unknown runtime option %q", option)
+		return false, nil
+	case unknownOptionsPassthrough:
+		if !mindxcheckutils.StringChecker(option, 0, mindxcheckutils.DefaultStringSize, "_=-") {
+			return false, fmt.Errorf("invalid runtime option")
+		}
+		hookLog.Warnf("Ascend-kata-hook: keep unknown runtime option %q, which is not used by the hook", option)
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid runtime option")
+	}
+}
+
+// parseDeviceManagers parses the comma separated names of the device manager nodes under /dev,
+// empty managers means only the davinci devices are created
+func parseDeviceManagers(managers string) ([]string, error) {
+	names := make([]string, 0)
+	if strings.TrimSpace(managers) == "" {
+		return names, nil
+	}
+	for _, name := range strings.Split(managers, ",") {
+		name = strings.TrimSpace(name)
+		if !mindxcheckutils.StringChecker(name, 0, mindxcheckutils.DefaultStringSize, "-_") {
+			return nil, fmt.Errorf("invalid device manager name %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// checkDeviceManagers makes sure every device manager is an existing char device before any of them is created
+func checkDeviceManagers() error {
+	for _, name := range deviceManagerNames {
+		devfile := path.Join(hostDevPath, name)
+		fileInfo, err := os.Stat(devfile)
+		if err != nil {
+			return fmt.Errorf("device manager %s doesn't exist on host: %v", devfile, err)
+		}
+		if fileInfo.Mode()&os.ModeCharDevice == 0 {
+			return fmt.Errorf("device manager %s is not a char device", devfile)
+		}
+	}
+	return nil
+}
+
+// checkDeviceNode makes sure the davinci device is a char device, of the majors given by -device-majors if any.
+// anything else at the path means a broken driver install, which is reported instead of being created
+func checkDeviceNode(devfile string) error {
+	var stat unix.Stat_t
+	if err := unix.Stat(devfile, &stat); err != nil {
+		return fmt.Errorf("device %s doesn't exist on host: %v", devfile, err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFCHR {
+		return fmt.Errorf("device %s is not a char device, the driver install may be broken", devfile)
+	}
+	major := int64(unix.Major(stat.Rdev))
+	if _, ok := deviceMajors[major]; len(deviceMajors) != 0 && !ok {
+		return fmt.Errorf("device %s has major %d, which is not one of the ascend device majors", devfile, major)
+	}
+	return nil
+}
+
 func parseSoftLinkMode(allowLink string) (string, error) {
 	if allowLink == "True" {
 		return "True", nil
@@ -174,257 +706,2780 @@ func parseOciSpecFile(file string) (*specs.Spec, error) {
 		return nil, fmt.Errorf("invalid OCI spec for empty process")
 	}
 
-	if spec.Root == nil {
-		return nil, fmt.Errorf("invalid OCI spec for empty root")
-	}
+	if spec.Root == nil {
+		return nil, fmt.Errorf("invalid OCI spec for empty root")
+	}
+
+	return spec, nil
+}
+
+// readContainerState reads the OCI state from stdin, at most maxStateSize bytes are accepted
+func readContainerState() (*containerState, error) {
+	if maxStateSize <= 0 {
+		return nil, fmt.Errorf("invalid max state size %d", maxStateSize)
+	}
+	// read one more byte than allowed so an oversized state can be told apart from a truncated one
+	stateBytes, err := ioutil.ReadAll(io.LimitReader(containerConfigInputStream, maxStateSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the container's state: %v", err)
+	}
+	if int64(len(stateBytes)) > maxStateSize {
+		return nil, fmt.Errorf("the container's state exceeds the limit of %d bytes", maxStateSize)
+	}
+
+	state := new(containerState)
+	if err := json.Unmarshal(stateBytes, state); err != nil {
+		return nil, fmt.Errorf("failed to parse the container's state")
+	}
+	return state, nil
+}
+
+var getContainerConfig = func() (*containerConfig, error) {
+	state, err := readContainerState()
+	if err != nil {
+		return nil, err
+	}
+	// the pid is used to enter the container's namespaces, a malformed state should not get that far
+	if state.Pid <= 0 {
+		return nil, fmt.Errorf("invalid pid %d in the container's state", state.Pid)
+	}
+
+	configPath, err := findBundleConfig(state.Bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	ociSpec, err := parseOciSpecFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse OCI spec: %v", err)
+	}
+	if len(ociSpec.Process.Env) > maxCommandLength {
+		return nil, fmt.Errorf("too many items in spec file")
+	}
+	// when use ctr->containerd. the rootfs in config.json is a relative path, which is relative to
+	// the dir of config.json even if the state points elsewhere
+	rfs := ociSpec.Root.Path
+	if !filepath.IsAbs(rfs) {
+		rfs = path.Join(path.Dir(configPath), ociSpec.Root.Path)
+	}
+
+	ret := &containerConfig{
+		Pid:       state.Pid,
+		Rootfs:    rfs,
+		Env:       ociSpec.Process.Env,
+		ID:        state.ID,
+		SandboxID: getSandboxID(state),
+		Cwd:       ociSpec.Process.Cwd,
+	}
+	if ociSpec.Linux != nil && ociSpec.Linux.Resources != nil {
+		ret.DeviceRules = ociSpec.Linux.Resources.Devices
+	}
+
+	return ret, nil
+}
+
+// findBundleConfig finds config.json of the bundle. some containerd versions give the rootfs dir as the bundle,
+// so the alternate locations in bundleConfigPaths are tried in order when the bundle has no config.json
+func findBundleConfig(bundle string) (string, error) {
+	for i, relative := range bundleConfigPaths {
+		configPath := path.Join(bundle, relative)
+		if _, err := os.Stat(configPath); os.IsNotExist(err) {
+			continue
+		}
+		if _, err := checkRealFile(configPath, true, true, mindxcheckutils.DefaultSize); err != nil {
+			return "", fmt.Errorf("check config.json %s of the bundle failed: %v", configPath, err)
+		}
+		if i > 0 {
+			hookLog.Infof("Ascend-kata-hook: config.json is not in bundle %s, use %s", bundle, configPath)
+		}
+		return configPath, nil
+	}
+	return "", fmt.Errorf("config.json not found at %s, bundle: %s", path.Join(bundle, bundleConfigPaths[0]), bundle)
+}
+
+// getSandboxID gets the sandbox id given by the CRI shim either in the state or in its annotations
+func getSandboxID(state *containerState) string {
+	if state.SandboxID != "" {
+		return state.SandboxID
+	}
+	for _, key := range []string{"io.kubernetes.cri.sandbox-id", "io.kubernetes.cri-o.SandboxID"} {
+		if id, ok := state.Annotations[key]; ok {
+			return id
+		}
+	}
+	return ""
+}
+
+func makeEnvNameSet(names []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		set[name] = struct{}{}
+	}
+	return set
+}
+
+// parseEnvAllowlist parses the comma separated container variables the hook reads, all of them are read
+// when the allowlist is empty. only the variables known by the hook can be listed
+func parseEnvAllowlist(allowlist string) (map[string]struct{}, error) {
+	if strings.TrimSpace(allowlist) == "" {
+		return makeEnvNameSet(containerEnvNames), nil
+	}
+	known := makeEnvNameSet(containerEnvNames)
+	names := make([]string, 0)
+	for _, name := range strings.Split(allowlist, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := known[name]; !ok {
+			return nil, fmt.Errorf("unknown env %q in allowlist, known are %s", name, strings.Join(containerEnvNames, ","))
+		}
+		names = append(names, name)
+	}
+	return makeEnvNameSet(names), nil
+}
+
+// parseConfigDirs parses the comma separated config dirs the containers are allowed to choose
+func parseConfigDirs(dirs string) ([]string, error) {
+	parsed := make([]string, 0)
+	for _, dir := range strings.Split(dirs, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("allowed config dir %s should be an absolute path", dir)
+		}
+		parsed = append(parsed, filepath.Clean(dir))
+	}
+	return parsed, nil
+}
+
+// chooseConfigDir picks the config dir of the container. the node's config dir is used unless the container
+// chooses one by ASCEND_CONTAINER_CONFIG_DIR, which should be one of the allowed config dirs so that a container
+// can not make the hook read any dir of the host
+func chooseConfigDir(env []string) (string, error) {
+	dir, err := getAscendValue(env, ascendConfigDir)
+	if err != nil {
+		return "", err
+	}
+	if dir == "" {
+		return mountConfigDir, nil
+	}
+	for _, allowed := range allowedConfigDirs {
+		if filepath.Clean(dir) == allowed {
+			hookLog.Infof("Ascend-kata-hook: use config dir %s chosen by the container", allowed)
+			return allowed, nil
+		}
+	}
+	return "", fmt.Errorf("config dir %s chosen by %s is not allowed by -allowed-config-dirs", dir, ascendConfigDir)
+}
+
+// lookupContainerEnv looks up a variable of the container, the variable not allowed is taken as unset
+func lookupContainerEnv(env []string, name string) (string, bool) {
+	if _, ok := allowedEnvNames[name]; !ok {
+		return "", false
+	}
+	return lookupAliasedValue(env, name)
+}
+
+// lookupAliasedValue looks up the canonical variable first and falls back to its legacy names in order
+func lookupAliasedValue(env []string, name string) (string, bool) {
+	if value, isSet := lookupValueByKey(env, name); isSet {
+		return value, true
+	}
+	for _, legacy := range envAliases[name] {
+		if value, isSet := lookupValueByKey(env, legacy); isSet {
+			warnDeprecated(deprecatedEnvAliasUsage+":"+legacy, "%s is a legacy name, use %s instead", legacy, name)
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// warnDeprecated logs the deprecated behavior once per run, so that the users relying on it are told before
+// it changes. the warnings are silenced by ASCEND_HOOK_NO_DEPRECATION_WARNINGS=true in the hook's env
+func warnDeprecated(behavior string, format string, args ...interface{}) {
+	if _, ok := deprecationsWarned[behavior]; ok {
+		return
+	}
+	deprecationsWarned[behavior] = struct{}{}
+	if silenced, err := strconv.ParseBool(os.Getenv(ascendHookNoDeprecated)); err == nil && silenced {
+		return
+	}
+	hookLog.Warnf("Ascend-kata-hook: deprecated: "+format, args...)
+}
+
+// checkEnvConflicts reports the legacy names set to other values than their canonical variables, the canonical
+// ones take precedence anyway. the conflicts are warned, or fail the hook with -strict-env
+func checkEnvConflicts(env []string) error {
+	for _, name := range containerEnvNames {
+		if _, ok := allowedEnvNames[name]; !ok {
+			continue
+		}
+		value, isSet := lookupValueByKey(env, name)
+		if !isSet {
+			continue
+		}
+		for _, legacy := range envAliases[name] {
+			legacyValue, legacySet := lookupValueByKey(env, legacy)
+			if !legacySet || legacyValue == value {
+				continue
+			}
+			if strictEnv {
+				return fmt.Errorf("%s=%q conflicts with %s=%q", name, value, legacy, legacyValue)
+			}
+			hookLog.Warnf("Ascend-kata-hook: %s=%q conflicts with %s=%q, %s is used", name, value, legacy,
+				legacyValue, name)
+		}
+	}
+	return nil
+}
+
+// loadEnvAliases loads the legacy names of the container variables, each line is <legacy name> <canonical name>,
+// empty lines and lines starting with # are ignored. no aliases are loaded when the file does not exist
+func loadEnvAliases(file string) (map[string][]string, error) {
+	aliases := make(map[string][]string)
+	if _, err := os.Lstat(file); os.IsNotExist(err) {
+		return aliases, nil
+	}
+	f, err := openCheckedFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("check env alias config %s failed: %w", file, err)
+	}
+	defer f.Close()
+	known := makeEnvNameSet(containerEnvNames)
+	seen := make(map[string]struct{})
+	scanner := bufio.NewScanner(io.LimitReader(f, oneMegabyte))
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != kvPairSize {
+			return nil, fmt.Errorf("line %d of %s should be <legacy name> <canonical name>", i, file)
+		}
+		legacy, name := fields[0], fields[1]
+		if _, ok := known[name]; !ok {
+			return nil, fmt.Errorf("unknown env %q on line %d of %s, known are %s", name, i, file,
+				strings.Join(containerEnvNames, ","))
+		}
+		if _, ok := known[legacy]; ok {
+			return nil, fmt.Errorf("%s on line %d of %s is a canonical name", legacy, i, file)
+		}
+		if !mindxcheckutils.StringChecker(legacy, 0, mindxcheckutils.DefaultStringSize, "_") {
+			return nil, fmt.Errorf("invalid env name %q on line %d of %s", legacy, i, file)
+		}
+		if _, ok := seen[legacy]; ok {
+			return nil, fmt.Errorf("%s is aliased more than once in %s", legacy, file)
+		}
+		seen[legacy] = struct{}{}
+		aliases[name] = append(aliases[name], legacy)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", file, err)
+	}
+	return aliases, nil
+}
+
+func getValueByKey(data []string, name string) string {
+	value, _ := lookupValueByKey(data, name)
+	return value
+}
+
+// lookupValueByKey gets the value of name and whether it is set, so that an empty value can be told apart from unset
+func lookupValueByKey(data []string, name string) (string, bool) {
+	for _, s := range data {
+		p := strings.SplitN(s, "=", 2)
+		if len(p) != kvPairSize {
+			log.Panicln("environment error")
+		}
+
+		if p[0] == name && len(p) == kvPairSize {
+			return p[1], true
+		}
+	}
+
+	return "", false
+}
+
+// getEnvPrefix gets the prefix of the ascend variables, the container's setting takes precedence over the hook's
+func getEnvPrefix(env []string) (string, error) {
+	prefix, _ := lookupContainerEnv(env, ascendEnvPrefix)
+	if prefix == "" {
+		prefix = envPrefix
+	}
+	if prefix == "" {
+		return "", nil
+	}
+	const maxPrefixLength = 64
+	if !mindxcheckutils.StringChecker(prefix, 0, maxPrefixLength, "_") {
+		return "", fmt.Errorf("invalid env prefix %q", prefix)
+	}
+	return prefix, nil
+}
+
+// getAscendValue looks up the prefixed variable first and falls back to the bare name
+func getAscendValue(env []string, name string) (string, error) {
+	value, _, err := lookupAscendValue(env, name)
+	return value, err
+}
+
+// lookupAscendValue is getAscendValue which also tells whether the variable is set
+func lookupAscendValue(env []string, name string) (string, bool, error) {
+	if _, ok := allowedEnvNames[name]; !ok {
+		return "", false, nil
+	}
+	prefix, err := getEnvPrefix(env)
+	if err != nil {
+		return "", false, err
+	}
+	if prefix != "" {
+		if value := getValueByKey(env, prefix+name); value != "" {
+			return value, true, nil
+		}
+	}
+	value, isSet := lookupAliasedValue(env, name)
+	return value, isSet, nil
+}
+
+// parseMountEntry parses a line of the mount config, which is a host path optionally
+// followed by a propagation mode, e.g. "/usr/local/Ascend/driver rslave".
+// the line could start with "@<runtime option>" so that the entry only applies with the option
+func parseMountEntry(line string) (mountEntry, error) {
+	fields := strings.Fields(line)
+	condition := ""
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		condition = strings.TrimPrefix(fields[0], "@")
+		if !isRuntimeOptionValid(condition) {
+			return mountEntry{}, fmt.Errorf("unknown runtime option %s in condition", condition)
+		}
+		fields = fields[1:]
+		if len(fields) == 0 {
+			return mountEntry{}, fmt.Errorf("no path after condition in mount entry %s", line)
+		}
+	}
+	probe := ""
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "?") {
+		probe = strings.TrimPrefix(fields[0], "?")
+		if err := checkProbe(probe); err != nil {
+			return mountEntry{}, err
+		}
+		fields = fields[1:]
+		if len(fields) == 0 {
+			return mountEntry{}, fmt.Errorf("no path after probe in mount entry %s", line)
+		}
+	}
+	entry, err := parseMountPath(line, fields)
+	entry.Condition, entry.Probe = condition, probe
+	return entry, err
+}
+
+func parseMountPath(line string, fields []string) (mountEntry, error) {
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "!") {
+		excluded := strings.TrimPrefix(fields[0], "!")
+		if len(fields) != 1 || !filepath.IsAbs(excluded) {
+			return mountEntry{}, fmt.Errorf("exclusion should be a single absolute path in mount entry %s", line)
+		}
+		return mountEntry{Path: filepath.Clean(excluded), Exclude: true}, nil
+	}
+	if len(fields) > 1 && fields[len(fields)-1] == copyMode {
+		if len(fields) != kvPairSize {
+			return mountEntry{}, fmt.Errorf("copy can not be used with a propagation in mount entry %s", line)
+		}
+		return mountEntry{Path: fields[0], Copy: true}, nil
+	}
+	if len(fields) > 1 && fields[len(fields)-1] == deviceMode {
+		if len(fields) != kvPairSize || !filepath.IsAbs(fields[0]) {
+			return mountEntry{}, fmt.Errorf("device should be a single absolute path in mount entry %s", line)
+		}
+		return mountEntry{Path: filepath.Clean(fields[0]), Device: true}, nil
+	}
+	switch len(fields) {
+	case 0:
+		return mountEntry{}, nil
+	case 1:
+		return mountEntry{Path: fields[0]}, nil
+	case kvPairSize:
+		if _, ok := mountPropagations[fields[1]]; !ok {
+			return mountEntry{}, fmt.Errorf("unknown mount propagation %s", fields[1])
+		}
+		return mountEntry{Path: fields[0], Propagation: fields[1]}, nil
+	default:
+		return mountEntry{}, fmt.Errorf("too many fields in mount entry %s", line)
+	}
+}
+
+// checkProbe makes sure the probe is one of the known checks, no probe runs any command:
+//
+//	exists:<absolute path>  the path exists on the node
+//	module:<name>           the kernel module is loaded, i.e. /sys/module/<name> exists
+func checkProbe(probe string) error {
+	kind, arg, found := strings.Cut(probe, ":")
+	if !found || arg == "" {
+		return fmt.Errorf("invalid probe %q, it should be <kind>:<argument>", probe)
+	}
+	switch kind {
+	case probeExists:
+		if !filepath.IsAbs(arg) || strings.Contains(arg, "..") {
+			return fmt.Errorf("probe %s should check an absolute path", probe)
+		}
+	case probeModule:
+		if !mindxcheckutils.StringChecker(arg, 0, mindxcheckutils.DefaultStringSize, "_-") {
+			return fmt.Errorf("invalid module name in probe %s", probe)
+		}
+	default:
+		return fmt.Errorf("unknown probe %s", kind)
+	}
+	return nil
+}
+
+// isProbeMet runs the probe of the entry on the node, the entry always applies when it has no probe
+func isProbeMet(entry mountEntry) bool {
+	if entry.Probe == "" {
+		return true
+	}
+	kind, arg, _ := strings.Cut(entry.Probe, ":")
+	probePath := arg
+	if kind == probeModule {
+		probePath = filepath.Join(sysModulePath, arg)
+	}
+	_, err := os.Stat(probePath)
+	return err == nil
+}
+
+// isConditionMet checks whether the runtime option required by the entry is given, with or without a parameter
+func isConditionMet(entry mountEntry, options []string) bool {
+	if entry.Condition == "" {
+		return true
+	}
+	for _, option := range options {
+		if runtimeOptionName(option) == entry.Condition {
+			return true
+		}
+	}
+	return false
+}
+
+// readMountConfig reads the mount config name under dir, the dir and its parents should have been checked
+// by the caller. the paths in seen are skipped and the paths read are added to seen
+func readMountConfig(dir string, name string, options []string,
+	seen map[string]mountEntry) ([]mountEntry, []mountEntry, error) {
+	configFileName := fmt.Sprintf("%s.%s", name, configFileSuffix)
+	// the variant of the node's architecture takes precedence, e.g. base.arm64.list over base.list
+	archFileName := fmt.Sprintf("%s.%s.%s", name, goArch, configFileSuffix)
+	if _, err := os.Lstat(filepath.Join(dir, archFileName)); err == nil {
+		hookLog.Infof("Ascend-kata-hook: use %s for config %s on %s", archFileName, name, goArch)
+		configFileName = archFileName
+	}
+	baseConfigFilePath, err := filepath.Abs(filepath.Join(dir, configFileName))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to assemble base config file path: %v", err)
+	}
+
+	f, err := openCheckedFile(baseConfigFilePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("check mount config %s failed: %w", baseConfigFilePath, err)
+	}
+	defer f.Close()
+
+	// the file is read no further than the size allowed even if it grows after being checked
+	return readMountEntries(io.LimitReader(f, mindxcheckutils.DefaultSize*oneMegabyte), baseConfigFilePath, name,
+		options, seen)
+}
+
+// readMountSection reads the mount config name from its section of the combined config under dir,
+// the error wraps os.ErrNotExist when there is no such section
+func readMountSection(dir string, name string, options []string,
+	seen map[string]mountEntry) ([]mountEntry, []mountEntry, error) {
+	sections, err := readCombinedConfig(filepath.Join(dir, combinedConfigFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	lines, ok := sections[name+"."+goArch]
+	if ok {
+		name = name + "." + goArch
+	} else {
+		lines, ok = sections[name]
+	}
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown config %s, there is neither %s.%s nor section [%s] in %s: %w", name,
+			name, configFileSuffix, name, combinedConfigFile, os.ErrNotExist)
+	}
+	source := fmt.Sprintf("%s[%s]", filepath.Join(dir, combinedConfigFile), name)
+	return readMountEntries(strings.NewReader(strings.Join(lines, "\n")), source, name, options, seen)
+}
+
+// readCombinedConfig reads the combined config which holds several mount configs, each one starts with
+// a [name] line followed by the lines of the config, e.g.
+//
+//	[base]
+//	/usr/local/Ascend/driver/lib64
+//	[tools]
+//	/usr/local/bin/npu-smi
+func readCombinedConfig(file string) (map[string][]string, error) {
+	f, err := openCheckedFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("check mount config %s failed: %w", file, err)
+	}
+	defer f.Close()
+
+	sections := make(map[string][]string)
+	name := ""
+	scanner := bufio.NewScanner(io.LimitReader(f, mindxcheckutils.DefaultSize*oneMegabyte))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name = strings.TrimSpace(line[1 : len(line)-1])
+			if !isMountConfigNameValid(name) || strings.ToLower(name) != name {
+				return nil, fmt.Errorf("invalid section name %q on line %d of %s", name, lineNumber, file)
+			}
+			if _, ok := sections[name]; ok {
+				return nil, fmt.Errorf("section [%s] is defined more than once in %s", name, file)
+			}
+			sections[name] = make([]string, 0)
+			continue
+		}
+		if name == "" {
+			if line != "" {
+				return nil, fmt.Errorf("line %d of %s is not in any section", lineNumber, file)
+			}
+			continue
+		}
+		sections[name] = append(sections[name], line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", file, err)
+	}
+	return sections, nil
+}
+
+// readMountEntries reads the entries of the mount config name from r, source names where the entries are
+// read from in the errors. the paths in seen are skipped and the paths read are added to seen
+func readMountEntries(r io.Reader, source string, name string, options []string,
+	seen map[string]mountEntry) ([]mountEntry, []mountEntry, error) {
+	fileMountList, dirMountList := make([]mountEntry, 0), make([]mountEntry, 0)
+	entryCount, listed := 0, 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		entryCount = entryCount + 1
+		if entryCount > maxEntryNumber {
+			return nil, nil, fmt.Errorf("mount list too long")
+		}
+		entry, err := parseMountEntry(scanner.Text())
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid entry in %s: %v", source, err)
+		}
+		if entry.Path == "" {
+			continue
+		}
+		listed++
+		if !isConditionMet(entry, options) {
+			logSkippedEntry(name, entry.Path, skipConditionNotMet, nil)
+			continue
+		}
+		if !isProbeMet(entry) {
+			logSkippedEntry(name, entry.Path, skipProbeFailed, nil)
+			continue
+		}
+		// the exclusions are applied after all the configs are read
+		if entry.Exclude {
+			dirMountList = append(dirMountList, entry)
+			continue
+		}
+		if first, ok := seen[entry.Path]; ok {
+			if err := checkDuplicatedEntry(first, entry, name); err != nil {
+				return nil, nil, fmt.Errorf("invalid entry in %s: %v", source, err)
+			}
+			continue
+		}
+		seen[entry.Path] = entry
+		configuredPath := entry.Path
+		entry, isDir, err := resolveMountEntry(entry)
+		if errors.Is(err, errSymlinkRejected) {
+			return nil, nil, fmt.Errorf("invalid entry in %s: %v", source, err)
+		}
+		if err != nil {
+			logSkippedEntry(name, entry.Path, getSkipReason(err), err)
+			continue // skipping files/dirs with any problems
+		}
+		// different paths resolved to the same one would be mounted to the same destination in the container
+		if _, ok := seen[entry.Path]; ok && entry.Path != configuredPath {
+			if strictMounts {
+				return nil, nil, fmt.Errorf("invalid entry in %s: %s is mounted more than once", source,
+					entry.Path)
+			}
+			logSkippedEntry(name, entry.Path, skipDuplicated, nil)
+			continue
+		}
+		seen[entry.Path] = entry
+		if err := checkCopyEntry(entry, isDir); err != nil {
+			return nil, nil, fmt.Errorf("invalid entry in %s: %v", source, err)
+		}
+
+		progress.addResolved()
+		if isDir {
+			dirMountList = append(dirMountList, entry)
+		} else {
+			fileMountList = append(fileMountList, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %v", source, err)
+	}
+	// a config truncated to empty contributes nothing, which is easily mistaken for being mounted
+	if listed == 0 {
+		hookLog.Warnf("Ascend-kata-hook: mount config %s has no entry, nothing is mounted from it", source)
+	}
+
+	return fileMountList, dirMountList, nil
+}
+
+// checkDuplicatedEntry checks the entry of a path listed again against the first one. the same entry is simply
+// skipped, while the one with different options, conditions or probes, e.g. dir after dir rslave or after
+// @VIRTUAL dir, fails with -strict-mounts or is skipped with a warning as only the first one is mounted
+func checkDuplicatedEntry(first mountEntry, entry mountEntry, name string) error {
+	// the entries are keyed by the configured path, so every field is compared
+	if first == entry {
+		return nil
+	}
+	err := fmt.Errorf("%s is listed again with options different from the first entry", entry.Path)
+	if strictMounts {
+		return err
+	}
+	logSkippedEntry(name, entry.Path, skipDuplicated, err)
+	return nil
+}
+
+// checkCopyEntry makes sure the entry to be copied is a file small enough
+func checkCopyEntry(entry mountEntry, isDir bool) error {
+	if !entry.Copy {
+		return nil
+	}
+	if isDir {
+		return fmt.Errorf("dir %s can not be copied", entry.Path)
+	}
+	stat, err := os.Stat(entry.Path)
+	if err != nil {
+		return err
+	}
+	if stat.Size() > maxCopySize {
+		return fmt.Errorf("%s of %d bytes is too large to copy, at most %d bytes are allowed", entry.Path,
+			stat.Size(), maxCopySize)
+	}
+	return nil
+}
+
+// openCheckedFile opens the file and makes sure what is checked is what is opened. the opened
+// descriptor is checked by fstat and compared with the checked path, so that the file can not be
+// swapped between the check and the read
+func openCheckedFile(file string) (*os.File, error) {
+	f, err := os.OpenFile(file, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", file, err)
+	}
+	if err := checkOpenedFile(f, file); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func checkOpenedFile(f *os.File, file string) error {
+	const groupOtherWrite = 0022
+	fdInfo, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat opened %s: %v", file, err)
+	}
+	if !fdInfo.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", file)
+	}
+	if fdInfo.Mode().Perm()&groupOtherWrite != 0 {
+		return fmt.Errorf("%s is writable by group or others", file)
+	}
+	stat, ok := fdInfo.Sys().(*syscall.Stat_t)
+	if !ok || !(stat.Uid == 0 || int(stat.Uid) == os.Getuid()) {
+		return fmt.Errorf("owner of %s is not right", file)
+	}
+	if _, err := mindxcheckutils.RealFileChecker(file, false, false, mindxcheckutils.DefaultSize); err != nil {
+		return err
+	}
+	pathInfo, err := os.Stat(file)
+	if err != nil {
+		return fmt.Errorf("cannot stat %s: %v", file, err)
+	}
+	if !os.SameFile(fdInfo, pathInfo) {
+		return fmt.Errorf("%s is changed while being checked", file)
+	}
+	return nil
+}
+
+// getSkipReason gets the reason code of the error skipping a mount entry
+func getSkipReason(err error) string {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return skipNotFound
+	case errors.Is(err, os.ErrPermission):
+		return skipPermission
+	case errors.Is(err, errWrongType):
+		return skipWrongType
+	default:
+		return skipOtherError
+	}
+}
+
+// logSkippedEntry logs the skipped mount entry in the form of key=value, config is empty for the entries
+// split from a dir mount. the entries skipped on purpose are only logged at debug level
+func logSkippedEntry(config string, mountPath string, reason string, err error) {
+	if reason == skipConditionNotMet || reason == skipProbeFailed {
+		hookLog.Debugf("Ascend-kata-hook: skip mount entry path=%s config=%s reason=%s", mountPath, config, reason)
+		return
+	}
+	hookLog.Warnf("Ascend-kata-hook: skip mount entry path=%s config=%s reason=%s error=%v", mountPath, config,
+		reason, err)
+}
+
+// resolveMountEntry makes the path of entry absolute and tells whether it is a dir,
+// error is returned when the entry should be skipped. a symlink entry is followed, resolved
+// to its target or rejected with errSymlinkRejected according to the symlink mode
+func resolveMountEntry(entry mountEntry) (mountEntry, bool, error) {
+	absMountPath, err := filepath.Abs(entry.Path)
+	if err != nil {
+		return entry, false, fmt.Errorf("get abs path failed: %v", err)
+	}
+	entry.Path = absMountPath
+
+	if mountSymlinkMode != symlinkFollow {
+		lstat, err := os.Lstat(entry.Path)
+		if err != nil {
+			return entry, false, err
+		}
+		if lstat.Mode()&os.ModeSymlink != 0 {
+			if mountSymlinkMode == symlinkReject {
+				return entry, false, fmt.Errorf("%s: %w", entry.Path, errSymlinkRejected)
+			}
+			realPath, err := filepath.EvalSymlinks(entry.Path)
+			if err != nil {
+				return entry, false, err
+			}
+			hookLog.Infof("Ascend-kata-hook: mount entry %s is resolved to %s", entry.Path, realPath)
+			entry.Path = realPath
+		}
+	}
+
+	stat, err := os.Stat(entry.Path)
+	if err != nil {
+		return entry, false, err
+	}
+	// the device nodes are only taken when they are marked, otherwise they are skipped as before
+	if entry.Device {
+		if stat.Mode()&os.ModeCharDevice == 0 {
+			return entry, false, fmt.Errorf("%s is not a character device: %w", entry.Path, errWrongType)
+		}
+		return entry, false, nil
+	}
+	if stat.Mode().IsRegular() {
+		return entry, false, nil
+	}
+	if stat.Mode().IsDir() {
+		return entry, true, nil
+	}
+	return entry, false, errWrongType
+}
+
+// validateMountConfig checks a mount config file offline and reports how every entry would be handled,
+// error is returned when the file is not usable or any entry is invalid or would be skipped
+func validateMountConfig(file string, out io.Writer) error {
+	realPath, err := mindxcheckutils.RealFileChecker(file, false, false, mindxcheckutils.DefaultSize)
+	if err != nil {
+		return fmt.Errorf("check mount config %s failed: %v", file, err)
+	}
+	f, err := os.Open(realPath)
+	if err != nil {
+		return fmt.Errorf("failed to open mount config %s: %v", file, err)
+	}
+	defer f.Close()
+
+	problems, lineNumber := 0, 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNumber++
+		if lineNumber > maxEntryNumber {
+			return fmt.Errorf("mount list too long, at most %d lines are allowed", maxEntryNumber)
+		}
+		entry, err := parseMountEntry(scanner.Text())
+		if err != nil {
+			problems++
+			fmt.Fprintf(out, "line %d: error: %v\n", lineNumber, err)
+			continue
+		}
+		if entry.Path == "" {
+			continue
+		}
+		if entry.Exclude {
+			fmt.Fprintf(out, "line %d: exclude %s from the dir mount containing it\n", lineNumber, entry.Path)
+			continue
+		}
+		entry, isDir, err := resolveMountEntry(entry)
+		if err != nil {
+			problems++
+			fmt.Fprintf(out, "line %d: skip %s (%s): %v\n", lineNumber, entry.Path, getSkipReason(err), err)
+			continue
+		}
+		if err := checkCopyEntry(entry, isDir); err != nil {
+			problems++
+			fmt.Fprintf(out, "line %d: error: %v\n", lineNumber, err)
+			continue
+		}
+		kind := "file"
+		if isDir {
+			kind = "dir"
+		}
+		if entry.Device {
+			kind = "device"
+		}
+		detail := ""
+		if entry.Copy {
+			detail += ", copied instead of mounted"
+		}
+		if entry.Propagation != "" {
+			detail += ", propagation " + entry.Propagation
+		}
+		if entry.Condition != "" {
+			detail += ", only with option " + entry.Condition
+		}
+		if entry.Probe != "" {
+			detail += fmt.Sprintf(", only when probe %s passes (%t on this node)", entry.Probe, isProbeMet(entry))
+		}
+		fmt.Fprintf(out, "line %d: mount %s %s%s\n", lineNumber, kind, entry.Path, detail)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read mount config %s: %v", file, err)
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d problems found in mount config %s", problems, file)
+	}
+	return nil
+}
+
+func readConfigsOfDir(dir string, configs []string, options []string) ([]mountEntry, []mountEntry, error) {
+	waitConfigDir(dir)
+	dir, err := resolveConfigDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the parents are checked once here instead of for every config file
+	if _, err := mindxcheckutils.RealDirChecker(dir, true, false); err != nil {
+		return nil, nil, fmt.Errorf("check config dir %s failed: %v", dir, err)
+	}
+	return readMountConfigs(dir, configs, options)
+}
+
+// readMountConfigs reads the configs under the checked dir, a missing config named with the prefix ? is
+// skipped while any other failure fails all
+func readMountConfigs(dir string, configs []string, options []string) ([]mountEntry, []mountEntry, error) {
+	fileMountList := make([]mountEntry, 0)
+	dirMountList := make([]mountEntry, 0)
+
+	configs, err := expandMountConfigs(dir, configs)
+	if err != nil {
+		return nil, nil, err
+	}
+	// a path listed by several configs is only stat and mounted once, the first entry wins
+	seen := make(map[string]mountEntry)
+	for _, config := range configs {
+		name := strings.TrimPrefix(config, optionalConfigPrefix)
+		fileList, dirList, err := readMountConfig(dir, name, options, seen)
+		// the config could be a section of the combined config instead of a file of its own
+		if _, statErr := os.Lstat(filepath.Join(dir, combinedConfigFile)); errors.Is(err, os.ErrNotExist) &&
+			statErr == nil {
+			fileList, dirList, err = readMountSection(dir, name, options, seen)
+		}
+		if err != nil && name != config && errors.Is(err, os.ErrNotExist) {
+			hookLog.Warnf("Ascend-kata-hook: optional config %s doesn't exist, skip it", name)
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to process config %s: %v", config, err)
+		}
+
+		fileMountList = append(fileMountList, fileList...)
+		dirMountList = append(dirMountList, dirList...)
+	}
+
+	fileMountList, dirMountList, err = applyMountExclusions(fileMountList, dirMountList)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fileMountList, dirMountList, nil
+}
+
+// applyMountExclusions takes the exclusions out of the dir mounts. a dir mount containing an excluded path is
+// replaced by the mounts of its children except the ones on the way to the excluded path, level by level
+func applyMountExclusions(fileMounts []mountEntry, dirMounts []mountEntry) ([]mountEntry, []mountEntry, error) {
+	excludes, kept := make([]mountEntry, 0), make([]mountEntry, 0, len(dirMounts))
+	for _, entry := range dirMounts {
+		if entry.Exclude {
+			excludes = append(excludes, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	dirMounts = kept
+
+	for _, exclude := range excludes {
+		fileCount, dirCount := len(fileMounts), len(dirMounts)
+		fileMounts = removeMountEntry(fileMounts, exclude.Path)
+		dirMounts = removeMountEntry(dirMounts, exclude.Path)
+		matched := fileCount != len(fileMounts) || dirCount != len(dirMounts)
+		// every dir mount containing the exclusion is split, the nested ones as well as the outer ones
+		split := make([]mountEntry, 0, len(dirMounts))
+		for _, parent := range dirMounts {
+			if !strings.HasPrefix(exclude.Path, parent.Path+"/") {
+				split = append(split, parent)
+				continue
+			}
+			childFiles, childDirs, err := splitDirMount(parent, nestedMountOnPath(dirMounts, parent.Path, exclude.Path))
+			if err != nil {
+				return nil, nil, err
+			}
+			split = append(split, childDirs...)
+			fileMounts = append(fileMounts, childFiles...)
+			matched = true
+		}
+		dirMounts = split
+		if !matched {
+			hookLog.Warnf("Ascend-kata-hook: excluded %s is not in any mount, ignore it", exclude.Path)
+		}
+	}
+	return fileMounts, dirMounts, nil
+}
+
+// nestedMountOnPath gets the outermost dir mount under parent on the way to exclude, which is split by itself,
+// so that parent is only split down to it instead of mounting its children twice. exclude itself is returned
+// when there is no such dir mount, the exclusions are never taken as one
+func nestedMountOnPath(dirMounts []mountEntry, parent string, exclude string) string {
+	nested := exclude
+	for _, entry := range dirMounts {
+		if !entry.Exclude && strings.HasPrefix(entry.Path, parent+"/") && strings.HasPrefix(exclude, entry.Path+"/") &&
+			len(entry.Path) < len(nested) {
+			nested = entry.Path
+		}
+	}
+	return nested
+}
+
+func removeMountEntry(entries []mountEntry, mountPath string) []mountEntry {
+	kept := make([]mountEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Path != mountPath {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// splitDirMount gets the mounts of the children of parent level by level down to exclude, the children on
+// the way to exclude are not mounted. the files added to parent on host afterwards are not seen in the container
+func splitDirMount(parent mountEntry, exclude string) ([]mountEntry, []mountEntry, error) {
+	rel, err := filepath.Rel(parent.Path, exclude)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get %s relative to %s: %v", exclude, parent.Path, err)
+	}
+	fileMounts, dirMounts := make([]mountEntry, 0), make([]mountEntry, 0)
+	current := parent.Path
+	for _, name := range strings.Split(rel, "/") {
+		children, err := ioutil.ReadDir(current)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s for exclusion: %v", current, err)
+		}
+		found := false
+		for _, child := range children {
+			if child.Name() == name {
+				found = true
+				continue
+			}
+			if len(fileMounts)+len(dirMounts) >= maxEntryNumber {
+				return nil, nil, fmt.Errorf("excluding %s from %s needs more than %d mounts", exclude, parent.Path,
+					maxEntryNumber)
+			}
+			entry, isDir, err := resolveMountEntry(mountEntry{Path: filepath.Join(current, child.Name()),
+				Propagation: parent.Propagation, Condition: parent.Condition})
+			if errors.Is(err, errSymlinkRejected) {
+				return nil, nil, err
+			}
+			if err != nil {
+				logSkippedEntry("", entry.Path, getSkipReason(err), err)
+				continue // skipping files/dirs with any problems
+			}
+			if isDir {
+				dirMounts = append(dirMounts, entry)
+			} else {
+				fileMounts = append(fileMounts, entry)
+			}
+		}
+		if !found {
+			hookLog.Warnf("Ascend-kata-hook: excluded %s doesn't exist, mount %s as a whole", exclude, parent.Path)
+			return []mountEntry{}, []mountEntry{parent}, nil
+		}
+		current = filepath.Join(current, name)
+	}
+	return fileMounts, dirMounts, nil
+}
+
+// resolveConfigDir resolves the config dir when it is a symlink, so that the checks afterwards are done on
+// the real dir. a dangling symlink or a symlink to a non-dir is told apart from a missing dir
+func resolveConfigDir(dir string) (string, error) {
+	fileInfo, err := os.Lstat(dir)
+	if err != nil {
+		return "", fmt.Errorf("cannot stat configuration directory %s : %v", dir, err)
+	}
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		if rejectConfigDirLink {
+			return "", fmt.Errorf("configuration directory %s is a symlink, which is rejected", dir)
+		}
+		target, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return "", fmt.Errorf("configuration directory %s is a dangling symlink: %v", dir, err)
+		}
+		hookLog.Infof("Ascend-kata-hook: configuration directory %s is resolved to %s", dir, target)
+		if fileInfo, err = os.Stat(target); err != nil {
+			return "", fmt.Errorf("cannot stat configuration directory %s : %v", target, err)
+		}
+		if !fileInfo.IsDir() {
+			return "", fmt.Errorf("configuration directory %s links to %s, which is not a dir", dir, target)
+		}
+		return target, nil
+	}
+
+	if !fileInfo.Mode().IsDir() {
+		return "", fmt.Errorf("%s should be a dir for ascend docker runtime, but now it is not", dir)
+	}
+	return dir, nil
+}
+
+// waitConfigDir waits up to configDirWait for the config dir to appear, for the containers started before
+// the node is fully provisioned. it returns at once when the dir exists or there is no wait
+func waitConfigDir(dir string) {
+	if configDirWait <= 0 {
+		return
+	}
+	deadline := time.Now().Add(configDirWait)
+	for attempt := 1; ; attempt++ {
+		if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+			return
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			hookLog.Warnf("Ascend-kata-hook: configuration directory %s doesn't appear in %v", dir, configDirWait)
+			return
+		}
+		hookLog.Infof("Ascend-kata-hook: wait for configuration directory %s to appear, attempt %d", dir, attempt)
+		if remaining > configDirWaitPeriod {
+			remaining = configDirWaitPeriod
+		}
+		time.Sleep(remaining)
+	}
+}
+
+// splitConfigArch splits the architecture off the config name, e.g. base.arm64 to base and arm64,
+// arch is empty when the name is not qualified with a known architecture
+func splitConfigArch(name string) (string, string) {
+	dot := strings.LastIndex(name, ".")
+	if dot <= 0 {
+		return name, ""
+	}
+	for _, arch := range configArchs {
+		if name[dot+1:] == arch {
+			return name[:dot], arch
+		}
+	}
+	return name, ""
+}
+
+// expandMountConfigs replaces the config name * with all the configs under dir sorted by name,
+// so that the config fragments dropped into dir by several packages are all used
+func expandMountConfigs(dir string, configs []string) ([]string, error) {
+	expanded := make([]string, 0, len(configs))
+	listed := make(map[string]struct{})
+	add := func(name string) {
+		if _, ok := listed[name]; !ok {
+			listed[name] = struct{}{}
+			expanded = append(expanded, name)
+		}
+	}
+	for _, config := range configs {
+		if config != allConfigs {
+			add(config)
+			continue
+		}
+		// ReadDir returns the files sorted by name
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read configuration directory %s: %v", dir, err)
+		}
+		for _, file := range files {
+			name := strings.TrimSuffix(file.Name(), "."+configFileSuffix)
+			if !file.Mode().IsRegular() || name == file.Name() || !isMountConfigNameValid(name) {
+				continue
+			}
+			// the variant of the node's architecture is picked when its config is read, the others are left out
+			if base, arch := splitConfigArch(name); arch == goArch {
+				name = base
+			} else if arch != "" {
+				continue
+			}
+			add(name)
+		}
+	}
+	return expanded, nil
+}
+
+func getArgs(cliPath string, containerConfig *containerConfig, fileMountList []string,
+	dirMountList []string, allowLink string) []string {
+	args := append([]string{cliPath},
+		"--allow-link", allowLink, "--pid", fmt.Sprintf("%d", containerConfig.Pid),
+		"--rootfs", containerConfig.Rootfs)
+	for _, filePath := range fileMountList {
+		args = append(args, "--mount-file", filePath)
+	}
+	for _, dirPath := range dirMountList {
+		args = append(args, "--mount-dir", dirPath)
+	}
+	return args
+}
+
+// getAscendEnv picks the ascend related variables, prefixed ones included, out of the container's env
+func getAscendEnv(env []string) map[string]string {
+	ascendEnv := make(map[string]string)
+	for _, s := range env {
+		p := strings.SplitN(s, "=", kvPairSize)
+		if len(p) == kvPairSize && strings.Contains(p[0], "ASCEND_") {
+			ascendEnv[p[0]] = p[1]
+		}
+	}
+	return ascendEnv
+}
+
+// resolveHookConfig resolves what the hook would do for the container, nothing is changed in the container
+func resolveHookConfig(containerConfig *containerConfig) (*hookConfig, error) {
+	cfg := &hookConfig{
+		ContainerID:    containerConfig.ID,
+		SandboxID:      containerConfig.SandboxID,
+		Pid:            containerConfig.Pid,
+		Rootfs:         containerConfig.Rootfs,
+		Env:            getAscendEnv(containerConfig.Env),
+		ConfigDir:      mountConfigDir,
+		RuntimeOptions: []string{},
+		MountConfigs:   []string{},
+		FileMounts:     []mountEntry{},
+		DirMounts:      []mountEntry{},
+		Devices:        []string{},
+		DeviceGid:      -1,
+	}
+
+	if isHookDisabled(containerConfig.Env) {
+		return cfg, nil
+	}
+	if err := checkEnvConflicts(containerConfig.Env); err != nil {
+		return nil, err
+	}
+	visibleDevices, err := getAscendValue(containerConfig.Env, ascendVisibleDevices)
+	if err != nil {
+		return nil, err
+	}
+	// the env takes precedence, the device rules of the spec are only consulted when it is unset
+	switch {
+	case visibleDevices != "":
+		hookLog.Infof("Ascend-kata-hook: has ascend device define: %#v", ascendVisibleDevices)
+	case useSpecDevices && hasAscendDeviceRule(containerConfig.DeviceRules):
+		hookLog.Infof("Ascend-kata-hook: ascend device is allowed by the device rules of the spec")
+	default:
+		_, mountsSet, err := lookupAscendValue(containerConfig.Env, ascendRuntimeMounts)
+		if err != nil {
+			return nil, err
+		}
+		if requireAscend && (!mountsSet || !mountsOnly) {
+			return nil, fmt.Errorf("%s is not set, the container is expected to be set up with -require-ascend",
+				ascendVisibleDevices)
+		}
+		if !mountsSet {
+			// a container of other workloads is told apart from a misconfigured one by its ascend variables
+			if len(cfg.Env) == 0 {
+				hookLog.Infof("Ascend-kata-hook: no ascend configuration found in the container, nothing to do")
+			} else {
+				hookLog.Infof("Ascend-kata-hook: hasn't ascend device: %#v", ascendVisibleDevices)
+			}
+			return cfg, nil
+		}
+		// the libraries requested without any device are easily taken as mounted, tell why they are not
+		if !mountsOnly {
+			hookLog.Warnf("Ascend-kata-hook: %s is set without %s, nothing is mounted. set %s as well, "+
+				"or run the hook with -mounts-only to mount without devices", ascendRuntimeMounts,
+				ascendVisibleDevices, ascendVisibleDevices)
+			return cfg, nil
+		}
+		hookLog.Infof("Ascend-kata-hook: %s is set without %s, only mount the configs", ascendRuntimeMounts,
+			ascendVisibleDevices)
+		cfg.MountsOnly = true
+	}
+	if skipWithoutNpu && !hasAscendHardware() {
+		hookLog.Infof("Ascend-kata-hook: no ascend hardware found on this node, skip the setup")
+		return cfg, nil
+	}
+	cfg.Enabled = true
+	runtimeOptions, err := getAscendValue(containerConfig.Env, ascendRuntimeOptions)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RuntimeOptions, err = parseRuntimeOptions(runtimeOptions); err != nil {
+		return nil, err
+	}
+	if sortRuntimeOptions {
+		sortOptions(cfg.RuntimeOptions)
+	}
+	mounts, isSet, err := lookupAscendValue(containerConfig.Env, ascendRuntimeMounts)
+	if err != nil {
+		return nil, err
+	}
+	mountConfigs, err := parseMounts(mounts, isSet)
+	if err != nil {
+		return nil, err
+	}
+	cfg.MountConfigs = mountConfigs
+	if cfg.ConfigDir, err = chooseConfigDir(containerConfig.Env); err != nil {
+		return nil, err
+	}
+
+	fileMountList, dirMountList, err := readConfigsOfDir(cfg.ConfigDir, cfg.MountConfigs, cfg.RuntimeOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration from config directory: %v", err)
+	}
+	cfg.FileMounts, cfg.DirMounts = fileMountList, dirMountList
+
+	if deviceGroup != "" {
+		if cfg.DeviceGid, err = resolveGroupID(containerConfig.Rootfs, deviceGroup); err != nil {
+			return nil, err
+		}
+	}
+
+	if mountDriverLibs {
+		driverLibs, err := findDriverLibs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find driver libraries: %v", err)
+		}
+		cfg.FileMounts = mergeDriverLibs(cfg.FileMounts, cfg.DirMounts, driverLibs)
+	}
+	if err := checkMountsNumber(cfg); err != nil {
+		return nil, err
+	}
+	if err := checkDriverVersion(cfg.FileMounts, cfg.DirMounts); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// hasAscendDeviceRule checks whether the device cgroup rules allow any ascend device on the node,
+// the ascend devices are matched by the major numbers of the davinci nodes under /dev
+func hasAscendDeviceRule(rules []specs.LinuxDeviceCgroup) bool {
+	if len(rules) == 0 {
+		return false
+	}
+	majors, err := getAscendDeviceMajors()
+	if err != nil {
+		hookLog.Warnf("Ascend-kata-hook: get the ascend device majors failed: %v", err)
+		return false
+	}
+	for _, rule := range rules {
+		if !rule.Allow || rule.Major == nil || (rule.Type != "c" && rule.Type != "a") {
+			continue
+		}
+		if _, ok := majors[*rule.Major]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// getAscendDeviceMajors gets the major numbers of the ascend devices, the ones given by -device-majors are
+// used when set, otherwise they are detected from the device nodes under /dev
+func getAscendDeviceMajors() (map[int64]struct{}, error) {
+	if len(deviceMajors) != 0 {
+		return deviceMajors, nil
+	}
+	devices, err := listDeviceNodes()
+	if err != nil {
+		return nil, err
+	}
+	majors := make(map[int64]struct{})
+	for _, device := range devices {
+		var stat unix.Stat_t
+		if err := unix.Stat(device, &stat); err != nil || stat.Mode&unix.S_IFMT != unix.S_IFCHR {
+			continue
+		}
+		majors[int64(unix.Major(stat.Rdev))] = struct{}{}
+	}
+	return majors, nil
+}
+
+// parseDeviceMajors parses the comma separated major numbers of the ascend devices. the majors are dynamic
+// char device majors, so the ones reserved by the kernel for well known devices are rejected
+func parseDeviceMajors(majors string) (map[int64]struct{}, error) {
+	parsed := make(map[int64]struct{})
+	if strings.TrimSpace(majors) == "" {
+		return parsed, nil
+	}
+	// majors below 10 are mem, tty and so on, 4095 is the largest major
+	const minMajor, maxMajor = 10, 4095
+	for _, major := range strings.Split(majors, ",") {
+		number, err := strconv.ParseInt(strings.TrimSpace(major), 10, 64)
+		if err != nil || number < minMajor || number > maxMajor {
+			return nil, fmt.Errorf("invalid device major %q, it should be in [%d, %d]", major, minMajor, maxMajor)
+		}
+		parsed[number] = struct{}{}
+	}
+	return parsed, nil
+}
+
+// isHookDisabled checks the safety switch, the hook is disabled for all containers by the file hook.disabled
+// under the config dir, or for one container by ASCEND_HOOK_DISABLE=true
+func isHookDisabled(env []string) bool {
+	disabledFile := filepath.Join(mountConfigDir, hookDisabledFile)
+	if _, err := os.Stat(disabledFile); err == nil {
+		hookLog.Warnf("Ascend-kata-hook: HOOK DISABLED by %s, no ascend device is set up", disabledFile)
+		return true
+	}
+	value, _ := lookupContainerEnv(env, ascendHookDisable)
+	if value == "" {
+		return false
+	}
+	disabled, err := strconv.ParseBool(value)
+	if err != nil {
+		hookLog.Warnf("Ascend-kata-hook: ignore invalid %s=%q", ascendHookDisable, value)
+		return false
+	}
+	if disabled {
+		hookLog.Warnf("Ascend-kata-hook: HOOK DISABLED by %s, no ascend device is set up", ascendHookDisable)
+	}
+	return disabled
+}
+
+// getDriverPath gets the driver path from the install info written by the driver package,
+// the default driver path is used when there is no install info
+func getDriverPath() (string, error) {
+	if _, err := os.Stat(ascendInstallInfoPath); err != nil {
+		return ascendDriverPath, nil
+	}
+	realPath, err := mindxcheckutils.RealFileChecker(ascendInstallInfoPath, true, false, mindxcheckutils.DefaultSize)
+	if err != nil {
+		return "", fmt.Errorf("check driver install info %s failed: %v", ascendInstallInfoPath, err)
+	}
+	f, err := os.Open(realPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %v", realPath, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		p := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", kvPairSize)
+		if len(p) == kvPairSize && p[0] == driverInstallPathKey && filepath.IsAbs(p[1]) {
+			return filepath.Join(p[1], "driver"), nil
+		}
+	}
+	return ascendDriverPath, nil
+}
+
+// readDriverVersion reads the version from the version.info of the driver dir
+func readDriverVersion(driverDir string) (string, error) {
+	const maxVersionFileSize = 64 * 1024
+	content, err := readFileWithLimit(filepath.Join(driverDir, driverVersionFile), maxVersionFileSize)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		p := strings.SplitN(strings.TrimSpace(line), "=", kvPairSize)
+		if len(p) == kvPairSize && p[0] == driverVersionKey && p[1] != "" {
+			return p[1], nil
+		}
+	}
+	return "", fmt.Errorf("no %s in %s", driverVersionKey, filepath.Join(driverDir, driverVersionFile))
+}
+
+// checkDriverVersion compares the driver version of the mounts having a version.info with the installed
+// driver, a mismatch is logged or fails the hook according to the version check mode
+func checkDriverVersion(fileMounts []mountEntry, dirMounts []mountEntry) error {
+	if driverVersionCheck == versionCheckOff {
+		return nil
+	}
+	driverPath, err := getDriverPath()
+	if err != nil {
+		return err
+	}
+	hostVersion, err := readDriverVersion(driverPath)
+	if err != nil {
+		hookLog.Warnf("Ascend-kata-hook: get version of the installed driver failed, skip the check: %v", err)
+		return nil
+	}
+	versionDirs := make([]string, 0)
+	for _, entry := range dirMounts {
+		versionDirs = append(versionDirs, entry.Path)
+	}
+	for _, entry := range fileMounts {
+		if filepath.Base(entry.Path) == driverVersionFile {
+			versionDirs = append(versionDirs, filepath.Dir(entry.Path))
+		}
+	}
+	for _, dir := range versionDirs {
+		version, err := readDriverVersion(dir)
+		if err != nil || version == hostVersion {
+			continue // not a driver dir
+		}
+		if driverVersionCheck == versionCheckError {
+			return fmt.Errorf("driver version %s of mount %s mismatches the installed driver %s", version, dir,
+				hostVersion)
+		}
+		hookLog.Warnf("Ascend-kata-hook: driver version %s of mount %s mismatches the installed driver %s",
+			version, dir, hostVersion)
+	}
+	return nil
+}
+
+// checkContainerCwd checks the working dir of the container process is a dir in the rootfs, a container
+// which can not start in its working dir gets nothing from the setup. a missing dir is logged or fails the hook
+// according to the cwd check mode
+func checkContainerCwd(containerConfig *containerConfig) error {
+	if cwdCheck == versionCheckOff || containerConfig.Cwd == "" {
+		return nil
+	}
+	cwd, err := securejoin.SecureJoin(containerConfig.Rootfs, containerConfig.Cwd)
+	if err != nil {
+		return fmt.Errorf("join cwd parent: %s, child: %s with err %v", containerConfig.Rootfs, containerConfig.Cwd,
+			err)
+	}
+	stat, err := os.Stat(cwd)
+	if err == nil && stat.IsDir() {
+		return nil
+	}
+	if err == nil {
+		err = fmt.Errorf("not a dir")
+	}
+	if cwdCheck == versionCheckError {
+		return fmt.Errorf("cwd %s of the container is not usable in the rootfs: %v", containerConfig.Cwd, err)
+	}
+	hookLog.Warnf("Ascend-kata-hook: cwd %s of the container is not usable in the rootfs, the container may fail "+
+		"to start: %v", containerConfig.Cwd, err)
+	return nil
+}
+
+// findDriverLibs finds all the regular files under the lib dir of the installed driver
+func findDriverLibs() ([]string, error) {
+	driverPath, err := getDriverPath()
+	if err != nil {
+		return nil, err
+	}
+	libDir := filepath.Join(driverPath, driverLibDir)
+	libs := make([]string, 0)
+	err = filepath.Walk(libDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		stat, err := os.Stat(file)
+		if err != nil || !stat.Mode().IsRegular() {
+			return nil // skipping dangling links and special files
+		}
+		// the libraries are all mounted, so they are limited by -max-mounts instead of the entries of a config
+		if len(libs) >= maxMounts {
+			return fmt.Errorf("more than %d driver libraries are found in %s, the limit is hit at %s, "+
+				"raise -max-mounts if the driver needs more", maxMounts, libDir, filepath.Dir(file))
+		}
+		libs = append(libs, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return libs, nil
+}
+
+// checkMountsNumber caps the mounts of all the configs together with the driver libraries merged into them
+func checkMountsNumber(cfg *hookConfig) error {
+	total := len(cfg.FileMounts) + len(cfg.DirMounts)
+	if total <= maxMounts {
+		return nil
+	}
+	source := "configs " + strings.Join(cfg.MountConfigs, ",")
+	if mountDriverLibs {
+		source += " and the driver libraries"
+	}
+	return fmt.Errorf("%d mounts are read from %s, at most %d are allowed", total, source, maxMounts)
+}
+
+// mergeDriverLibs adds the driver libraries which are not covered by the configured mounts
+func mergeDriverLibs(fileMounts []mountEntry, dirMounts []mountEntry, libs []string) []mountEntry {
+	covered := func(lib string) bool {
+		for _, file := range fileMounts {
+			if file.Path == lib {
+				return true
+			}
+		}
+		for _, dir := range dirMounts {
+			if strings.HasPrefix(lib, dir.Path+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	for _, lib := range libs {
+		if !covered(lib) {
+			fileMounts = append(fileMounts, mountEntry{Path: lib})
+		}
+	}
+	return fileMounts
+}
+
+// resolveGroupID resolves the group by the /etc/group of the container, a numeric group is used as gid directly
+func resolveGroupID(rootfs string, group string) (int, error) {
+	const maxGid = 1<<31 - 1
+	if gid, err := strconv.Atoi(group); err == nil {
+		if gid < 0 || gid > maxGid {
+			return -1, fmt.Errorf("invalid device group id %d", gid)
+		}
+		return gid, nil
+	}
+	if !mindxcheckutils.StringChecker(group, 0, mindxcheckutils.DefaultStringSize, "-_.") {
+		return -1, fmt.Errorf("invalid device group name %q", group)
+	}
+
+	groupFile, err := securejoin.SecureJoin(rootfs, "/etc/group")
+	if err != nil {
+		return -1, fmt.Errorf("join group file of rootfs %s failed: %v", rootfs, err)
+	}
+	const maxGroupFileSize = 1024 * 1024
+	content, err := readFileWithLimit(groupFile, maxGroupFileSize)
+	if err != nil {
+		return -1, fmt.Errorf("failed to read group file of the container: %v", err)
+	}
+	const gidIndex, minGroupFields = 2, 3
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < minGroupFields || fields[0] != group {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[gidIndex])
+		if err != nil || gid < 0 || gid > maxGid {
+			return -1, fmt.Errorf("invalid gid of group %s in the container", group)
+		}
+		return gid, nil
+	}
+	return -1, fmt.Errorf("group %s doesn't exist in the container", group)
+}
+
+// readFileWithLimit reads the whole file, error is returned when the file is larger than limit
+func readFileWithLimit(file string, limit int64) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(f, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > limit {
+		return nil, fmt.Errorf("file %s exceeds the limit of %d bytes", file, limit)
+	}
+	return content, nil
+}
+
+// listDeviceNodes lists the device nodes currently present on the node which would be created in the container
+func listDeviceNodes() ([]string, error) {
+	devices := make([]string, 0)
+	for _, name := range deviceManagerNames {
+		if _, err := os.Stat(path.Join(hostDevPath, name)); err == nil {
+			devices = append(devices, path.Join(hostDevPath, name))
+		}
+	}
+	devFiles, err := readDevDir(hostDevPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, devFile := range devFiles {
+		if strings.Contains(devFile, "davinci") && devFile != "davinci_manager" {
+			devices = append(devices, path.Join(hostDevPath, devFile))
+		}
+	}
+	return devices, nil
+}
+
+// readDevDir reads the names in the dev dir sorted, the scan is bounded by devScanTimeout and devScanMaxEntries
+// so that a misbehaving node fails the hook with a clear error instead of hanging it
+func readDevDir(dir string) ([]string, error) {
+	type scanResult struct {
+		names []string
+		err   error
+	}
+	// buffered so that the scan does not leak when it finishes after the timeout
+	done := make(chan scanResult, 1)
+	go func() {
+		names, err := readDirNames(dir, devScanMaxEntries)
+		done <- scanResult{names: names, err: err}
+	}()
+	select {
+	case result := <-done:
+		return result.names, result.err
+	case <-time.After(devScanTimeout):
+		return nil, fmt.Errorf("scan of %s timed out after %v", dir, devScanTimeout)
+	}
+}
+
+func readDirNames(dir string, maxEntries int) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", dir, err)
+	}
+	defer f.Close()
+	const batchSize = 256
+	names := make([]string, 0)
+	for {
+		batch, err := f.Readdirnames(batchSize)
+		names = append(names, batch...)
+		if len(names) > maxEntries {
+			return nil, fmt.Errorf("more than %d entries in %s", maxEntries, dir)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", dir, err)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// generateMountConfig writes a suggested base.list for the driver installed on the node to out, with the devices
+// found as comments. the paths not found are left commented out. nothing on the disk is changed, the operators
+// review the output and install it themselves
+func generateMountConfig(out io.Writer) error {
+	driverPath, err := getDriverPath()
+	if err != nil {
+		return err
+	}
+	version, err := readDriverVersion(driverPath)
+	if err != nil {
+		version = "unknown"
+	}
+	fmt.Fprintf(out, "# generated by %s -generate-config for the driver %s of version %s\n", hookName, driverPath,
+		version)
+	fmt.Fprintf(out, "# review it before installing it as %s\n",
+		filepath.Join(configDir, baseConfig+"."+configFileSuffix))
+	paths := make([]string, 0, len(generatedDriverPaths)+len(generatedNodePaths))
+	for _, relative := range generatedDriverPaths {
+		paths = append(paths, filepath.Join(driverPath, relative))
+	}
+	for _, p := range append(paths, generatedNodePaths...) {
+		if _, err := os.Stat(p); err != nil {
+			fmt.Fprintf(out, "# not found on this node: %s\n", p)
+			continue
+		}
+		fmt.Fprintln(out, p)
+	}
+
+	devices, err := listDeviceNodes()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "# %d device nodes found, created in the container besides the mounts:\n", len(devices))
+	for _, device := range devices {
+		fmt.Fprintf(out, "#   %s\n", device)
+	}
+	return nil
+}
+
+// dumpHookConfig writes the effective configuration as JSON to stdout, the container is left untouched
+func dumpHookConfig() error {
+	containerConfig, err := getContainerConfig()
+	if err != nil {
+		return fmt.Errorf("failed to get container config: %v", err)
+	}
+	cfg, err := resolveHookConfig(containerConfig)
+	if err != nil {
+		return err
+	}
+	if cfg.Enabled {
+		if cfg.Devices, err = listDeviceNodes(); err != nil {
+			return err
+		}
+	}
+	content, err := json.MarshalIndent(cfg, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal hook config: %v", err)
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(content))
+	return err
+}
+
+// replayHook runs every stage of the hook against the captured state without changing the container,
+// the result of each stage is printed so that a failure in the field can be reproduced
+func replayHook(out io.Writer) error {
+	fail := func(err error) error {
+		fmt.Fprintf(out, "error: %v\n", err)
+		return err
+	}
+
+	fmt.Fprintln(out, "== container")
+	containerConfig, err := getContainerConfig()
+	if err != nil {
+		return fail(fmt.Errorf("failed to get container config: %v", err))
+	}
+	fmt.Fprintf(out, "id: %s\nsandbox: %s\npid: %d\nrootfs: %s\n", containerConfig.ID,
+		containerConfig.SandboxID, containerConfig.Pid, containerConfig.Rootfs)
+
+	fmt.Fprintln(out, "== hook config")
+	cfg, err := resolveHookConfig(containerConfig)
+	if err != nil {
+		return fail(err)
+	}
+	content, err := json.MarshalIndent(cfg, "", "    ")
+	if err != nil {
+		return fail(fmt.Errorf("failed to marshal hook config: %v", err))
+	}
+	fmt.Fprintln(out, string(content))
+	if !cfg.Enabled {
+		fmt.Fprintln(out, "the hook is not enabled for the container, nothing to do")
+		return nil
+	}
+
+	fmt.Fprintln(out, "== mounts")
+	mounts, err := planMounts(containerConfig.Rootfs, cfg)
+	if err != nil {
+		return fail(err)
+	}
+	for _, m := range mounts {
+		if m.Copy {
+			fmt.Fprintf(out, "copy %s -> %s\n", m.Source, m.Dest)
+			continue
+		}
+		if m.Device {
+			fmt.Fprintf(out, "create %s -> %s\n", m.Source, m.Dest)
+			continue
+		}
+		fmt.Fprintf(out, "mount %s -> %s %s\n", m.Source, m.Dest, m.Propagation)
+	}
+
+	fmt.Fprintln(out, "== devices")
+	if cfg.MountsOnly {
+		fmt.Fprintln(out, "no device is requested, only the mounts are set up")
+		return nil
+	}
+	if err := checkDeviceManagers(); err != nil {
+		return fail(err)
+	}
+	devices, err := listDeviceNodes()
+	if err != nil {
+		return fail(err)
+	}
+	for _, device := range devices {
+		fmt.Fprintf(out, "create %s -> %s\n", device, path.Join(containerConfig.Rootfs, device))
+	}
+	return nil
+}
+
+// mountAction is a bind mount to be done in the container
+type mountAction struct {
+	Source      string
+	Dest        string
+	Propagation string
+	IsDir       bool
+	Copy        bool
+	Device      bool
+}
+
+// planMounts computes the bind mounts of the hook config, the files are mounted before the dirs.
+// nothing is changed, so that the setup and the replay share the same plan
+func planMounts(rootfs string, cfg *hookConfig) ([]mountAction, error) {
+	mounts := make([]mountAction, 0, len(cfg.FileMounts)+len(cfg.DirMounts))
+	for _, kind := range []struct {
+		name    string
+		entries []mountEntry
+		isDir   bool
+	}{{"file", cfg.FileMounts, false}, {"dir", cfg.DirMounts, true}} {
+		for _, entry := range kind.entries {
+			if _, err := os.Stat(entry.Path); err != nil {
+				return nil, fmt.Errorf("mount %s %s doesn't exist on host", kind.name, entry.Path)
+			}
+			dest, err := securejoin.SecureJoin(rootfs, entry.Path)
+			if err != nil {
+				return nil, fmt.Errorf("join %s parent: %s, child: %s with err %v", kind.name, rootfs, entry.Path, err)
+			}
+			mounts = append(mounts, mountAction{Source: entry.Path, Dest: dest, Propagation: entry.Propagation,
+				IsDir: kind.isDir, Copy: entry.Copy, Device: entry.Device})
+		}
+	}
+	return mounts, nil
+}
+
+func doPrestartHook() error {
+	endSpan := startStage("state decode")
+	containerConfig, err := getContainerConfig()
+	endSpan(err)
+	if err != nil {
+		return fmt.Errorf("failed to get container config: %v", err)
+	}
+
+	hookLog.Infof("Ascend-kata-hook: setup container %s of sandbox %s", containerConfig.ID,
+		containerConfig.SandboxID)
+	endSpan = startStage("config resolve")
+	cfg, err := resolveHookConfig(containerConfig)
+	endSpan(err)
+	if err != nil {
+		return err
+	}
+	if !cfg.Enabled {
+		return nil
+	}
+	if skip, err := checkEmptySetup(cfg); err != nil || skip {
+		return err
+	}
+	if err := checkContainerCwd(containerConfig); err != nil {
+		return err
+	}
+	if !cfg.MountsOnly {
+		if err := checkDeviceQuota(); err != nil {
+			return err
+		}
+	}
+	if runLogLevel <= debugLevel {
+		logResolvedConfig(cfg)
+	}
+	if err := setEnv(*containerConfig); err != nil {
+		return err
+	}
+	endSpan = startStage("mount")
+	err = mountAll(containerConfig.Rootfs, cfg)
+	endSpan(err)
+	if err != nil {
+		return err
+	}
+
+	if recordMounts {
+		if err := writeMountRecord(containerConfig.Rootfs, cfg); err != nil {
+			return err
+		}
+	}
+
+	if !cfg.MountsOnly {
+		endSpan = startStage("device")
+		err = mountDev(*containerConfig, cfg.DeviceGid)
+		endSpan(err)
+		if err != nil {
+			return err
+		}
+	}
+
+	if notifyPath != "" {
+		notifySetup(containerConfig)
+	}
+	if setupReport {
+		writeSetupReport(containerConfig.Rootfs, cfg)
+	}
+	return nil
+}
+
+// writeSetupReport writes what the hook has done to setupReportFile in the rootfs and the run log, so that
+// the users can confirm the setup in the container. failures are only logged as the report is informational
+func writeSetupReport(rootfs string, cfg *hookConfig) {
+	devices := []string{}
+	if !cfg.MountsOnly {
+		var err error
+		if devices, err = listDeviceNodes(); err != nil {
+			hookLog.Warnf("Ascend-kata-hook: list devices for setup report failed: %v", err)
+		}
+	}
+	copied, created := 0, 0
+	for _, entry := range cfg.FileMounts {
+		if entry.Copy {
+			copied++
+		}
+		if entry.Device {
+			created++
+			devices = append(devices, entry.Path)
+		}
+	}
+	var report strings.Builder
+	fmt.Fprintf(&report, "%s set up container %s at %s\n", hookName, cfg.ContainerID, time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&report, "exposed %d devices: %s\n", len(devices), strings.Join(devices, " "))
+	fmt.Fprintf(&report, "mounted %d files, %d dirs, copied %d files from configs %s\n",
+		len(cfg.FileMounts)-copied-created, len(cfg.DirMounts), copied, strings.Join(cfg.MountConfigs, ","))
+	for _, entry := range append(append([]mountEntry{}, cfg.FileMounts...), cfg.DirMounts...) {
+		fmt.Fprintf(&report, "  %s\n", entry.Path)
+	}
+	hookLog.Infof("Ascend-kata-hook: setup report of container %s: exposed %d devices, mounted %d paths",
+		cfg.ContainerID, len(devices), len(cfg.FileMounts)+len(cfg.DirMounts))
+
+	dest, err := securejoin.SecureJoin(rootfs, setupReportFile)
+	if err != nil {
+		hookLog.Warnf("Ascend-kata-hook: join setup report parent: %s, child: %s with err %v", rootfs,
+			setupReportFile, err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		hookLog.Warnf("Ascend-kata-hook: create dir of setup report %s failed: %v", dest, err)
+		return
+	}
+	if err := writeFileAtomic(dest, []byte(report.String())); err != nil {
+		hookLog.Warnf("Ascend-kata-hook: write setup report %s failed: %v", dest, err)
+	}
+}
+
+// checkDeviceQuota fails the setup before anything is done when the container would get more davinci
+// devices than -max-devices allows, 0 means no quota
+func checkDeviceQuota() error {
+	if maxDevices <= 0 {
+		return nil
+	}
+	devFiles, err := readDevDir(hostDevPath)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, devFile := range devFiles {
+		if strings.Contains(devFile, "davinci") && devFile != "davinci_manager" {
+			count++
+		}
+	}
+	if count > maxDevices {
+		return fmt.Errorf("%d davinci devices are found for the container, the quota is %d", count, maxDevices)
+	}
+	return nil
+}
+
+// logResolvedConfig writes the resolved mounts and devices to the debug log, which is what -dump prints
+// without another run of the hook. the devices are only scanned here when the debug log is enabled
+func logResolvedConfig(cfg *hookConfig) {
+	content, err := json.Marshal(cfg)
+	if err != nil {
+		hookLog.Debugf("Ascend-kata-hook: marshal resolved config failed: %v", err)
+		return
+	}
+	hookLog.Debugf("Ascend-kata-hook: resolved config %s", content)
+	if cfg.MountsOnly {
+		return
+	}
+	devices, err := listDeviceNodes()
+	if err != nil {
+		hookLog.Debugf("Ascend-kata-hook: list devices failed: %v", err)
+		return
+	}
+	hookLog.Debugf("Ascend-kata-hook: devices to create %s", strings.Join(devices, ","))
+}
+
+// mountAll bind mounts the planned mounts of the hook config into the rootfs
+func mountAll(rootfs string, cfg *hookConfig) error {
+	mounts, err := planMounts(rootfs, cfg)
+	if err != nil {
+		return err
+	}
+	// the copies are written into the rootfs, which is checked before anything is mounted
+	for _, m := range mounts {
+		if m.Copy {
+			if err := checkRootfsWritable(rootfs); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	for _, m := range mounts {
+		switch {
+		case m.Copy:
+			err = copyFile(m.Dest, m.Source)
+		case m.Device:
+			err = createDeviceNode(rootfs, m.Source, cfg.Pid, cfg.DeviceGid)
+		case m.IsDir:
+			err = bindMountDir(rootfs, m.Dest, m.Source, m.Propagation)
+		default:
+			err = bindMountFile(rootfs, m.Dest, m.Source, m.Propagation)
+		}
+		if err != nil {
+			return fmt.Errorf("bind mount source: %s, dest: %s with err %v", m.Source, m.Dest, err)
+		}
+		progress.addMounted()
+	}
+	return nil
+}
+
+// checkEmptySetup handles the container which would get neither mount nor davinci device according to
+// the empty setup mode, the setup is skipped when true is returned
+func checkEmptySetup(cfg *hookConfig) (bool, error) {
+	if emptySetupMode == emptySetupProceed || len(cfg.FileMounts) != 0 || len(cfg.DirMounts) != 0 {
+		return false, nil
+	}
+	devFiles, err := readDevDir(hostDevPath)
+	if err != nil {
+		return false, err
+	}
+	for _, devFile := range devFiles {
+		if strings.Contains(devFile, "davinci") && devFile != "davinci_manager" {
+			return false, nil
+		}
+	}
+	if emptySetupMode == emptySetupError {
+		return false, fmt.Errorf("neither mount nor davinci device is found for container %s", cfg.ContainerID)
+	}
+	hookLog.Infof("Ascend-kata-hook: neither mount nor davinci device is found for container %s, skip the setup",
+		cfg.ContainerID)
+	return true, nil
+}
+
+// notifySetup appends a JSON line with the container and its devices to notifyPath after a successful setup.
+// notifyPath can be a file or a named pipe, a failure is only logged and never fails the container
+func notifySetup(containerConfig *containerConfig) {
+	devices, err := listDeviceNodes()
+	if err != nil {
+		hookLog.Warnf("Ascend-kata-hook: list devices for notification failed: %v", err)
+		devices = []string{}
+	}
+	content, err := json.Marshal(struct {
+		ContainerID string   `json:"containerId"`
+		SandboxID   string   `json:"sandboxId,omitempty"`
+		Devices     []string `json:"devices"`
+	}{ContainerID: containerConfig.ID, SandboxID: containerConfig.SandboxID, Devices: devices})
+	if err != nil {
+		hookLog.Warnf("Ascend-kata-hook: marshal notification failed: %v", err)
+		return
+	}
+	// a named pipe without reader fails at once instead of blocking the container
+	f, err := os.OpenFile(notifyPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE|syscall.O_NONBLOCK|syscall.O_NOFOLLOW,
+		outputFileMode)
+	if err != nil {
+		hookLog.Warnf("Ascend-kata-hook: open notification %s failed: %v", notifyPath, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(content, '\n')); err != nil {
+		hookLog.Warnf("Ascend-kata-hook: write notification %s failed: %v", notifyPath, err)
+	}
+}
+
+// acquireNodeLock takes the advisory lock on file so that the hooks of the node set up containers one by one,
+// the returned func releases the lock. it fails after lockTimeout instead of waiting forever
+func acquireNodeLock(file string) (func(), error) {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %v", file, err)
+	}
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %v", file, err)
+		}
+		if time.Since(start) >= lockTimeout {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s in %v, it is held by another hook", file, lockTimeout)
+		}
+		if attempt == 1 {
+			hookLog.Infof("Ascend-kata-hook: lock %s is held by another hook, wait for it", file)
+		}
+		time.Sleep(lockRetryPeriod)
+	}
+	if waited := time.Since(start); waited >= lockRetryPeriod {
+		hookLog.Infof("Ascend-kata-hook: lock %s is acquired after %v", file, waited)
+	}
+	return func() {
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_UN); err != nil {
+			hookLog.Warnf("Ascend-kata-hook: unlock %s failed: %v", file, err)
+		}
+		f.Close()
+	}, nil
+}
+
+// hookTracer records the stages of the hook as spans and writes them in OTLP JSON,
+// it is nil when tracing is disabled so that the stages cost nothing
+type hookTracer struct {
+	traceID  string
+	parentID string
+	root     traceSpan
+	// mu guards spans, the setup left running after a timeout may still end its stages
+	mu    sync.Mutex
+	spans []traceSpan
+}
+
+type traceSpan struct {
+	name   string
+	spanID string
+	start  time.Time
+	end    time.Time
+	err    error
+}
+
+// newHookTracer starts the root span of the hook, which joins the trace of traceParent when it is a valid
+// W3C traceparent, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01, or starts a new trace
+func newHookTracer(traceParent string) *hookTracer {
+	t := &hookTracer{root: traceSpan{name: hookName, spanID: randomHex(8), start: time.Now()}}
+	parts := strings.Split(traceParent, "-")
+	const traceParentParts, traceIDLength, spanIDLength = 4, 32, 16
+	if len(parts) == traceParentParts && isHex(parts[1], traceIDLength) && isHex(parts[2], spanIDLength) {
+		t.traceID, t.parentID = parts[1], parts[2]
+	} else {
+		if traceParent != "" {
+			hookLog.Warnf("Ascend-kata-hook: invalid %s %q, start a new trace", traceParentEnv, traceParent)
+		}
+		t.traceID = randomHex(traceIDLength / 2)
+	}
+	return t
+}
+
+// hookProgress is how far the setup has got, which is logged when the setup times out
+type hookProgress struct {
+	mu       sync.Mutex
+	stage    string
+	resolved int
+	mounted  int
+}
+
+var progress = &hookProgress{}
+
+func (p *hookProgress) enter(stage string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stage = stage
+}
+
+func (p *hookProgress) addResolved() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resolved++
+}
+
+func (p *hookProgress) addMounted() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mounted++
+}
+
+func (p *hookProgress) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return fmt.Sprintf("stage %q with %d mount entries resolved and %d mounted", p.stage, p.resolved, p.mounted)
+}
+
+// startStage records the stage of the setup as the progress and starts its span
+func startStage(name string) func(error) {
+	progress.enter(name)
+	return tracer.startSpan(name)
+}
 
-	return spec, nil
+// setupPanic is the panic of the setup run in its own goroutine, raised again on the main goroutine with
+// the stack where it happened so that recoverPanic handles it as well
+type setupPanic struct {
+	value interface{}
+	stack []byte
 }
 
-var getContainerConfig = func() (*containerConfig, error) {
-	state := new(specs.State)
-	decoder := json.NewDecoder(containerConfigInputStream)
+type setupResult struct {
+	err   error
+	panic *setupPanic
+}
 
-	if err := decoder.Decode(state); err != nil {
-		return nil, fmt.Errorf("failed to parse the container's state")
+// runWithTimeout runs the setup and gives up after timeout with how far the setup has got, so that a hang,
+// e.g. a stat on a dead NFS mount, points at its stage. the setup left running ends with the hook process
+func runWithTimeout(setup func() error, timeout time.Duration) error {
+	if timeout <= 0 {
+		return setup()
+	}
+	// buffered so that the setup does not leak when it finishes after the timeout
+	done := make(chan setupResult, 1)
+	go func() {
+		// the defers of main do not see the panic of another goroutine, it is carried back with its stack
+		defer func() {
+			if r := recover(); r != nil {
+				done <- setupResult{panic: &setupPanic{value: r, stack: debug.Stack()}}
+			}
+		}()
+		done <- setupResult{err: setup()}
+	}()
+	select {
+	case result := <-done:
+		if result.panic != nil {
+			panic(result.panic)
+		}
+		return result.err
+	case <-time.After(timeout):
+		return fmt.Errorf("setup timed out after %v at %s", timeout, progress)
 	}
+}
 
-	configPath := path.Join(state.Bundle, "config.json")
-	if _, err := mindxcheckutils.RealFileChecker(configPath, true, true, mindxcheckutils.DefaultSize); err != nil {
-		return nil, err
+// startSpan starts the span of a stage, the returned func ends it with the result of the stage
+func (t *hookTracer) startSpan(name string) func(error) {
+	if t == nil {
+		return func(error) {}
+	}
+	span := traceSpan{name: name, spanID: randomHex(8), start: time.Now()}
+	return func(err error) {
+		span.end, span.err = time.Now(), err
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.spans = append(t.spans, span)
 	}
+}
 
-	ociSpec, err := parseOciSpecFile(configPath)
+// finish ends the root span and appends the trace as a JSON line to file, failures are only logged
+// as the trace should never fail the container
+func (t *hookTracer) finish(file string, err error) {
+	if t == nil {
+		return
+	}
+	t.root.end, t.root.err = time.Now(), err
+	spans := []map[string]interface{}{t.spanJSON(t.root, t.parentID)}
+	t.mu.Lock()
+	for _, span := range t.spans {
+		spans = append(spans, t.spanJSON(span, t.root.spanID))
+	}
+	t.mu.Unlock()
+	attribute := map[string]interface{}{"key": "service.name", "value": map[string]string{"stringValue": hookName}}
+	content, err := json.Marshal(map[string]interface{}{"resourceSpans": []interface{}{map[string]interface{}{
+		"resource":   map[string]interface{}{"attributes": []interface{}{attribute}},
+		"scopeSpans": []interface{}{map[string]interface{}{"scope": map[string]string{"name": hookName}, "spans": spans}},
+	}}})
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse OCI spec: %v", err)
-	}
-	if len(ociSpec.Process.Env) > maxCommandLength {
-		return nil, fmt.Errorf("too many items in spec file")
+		hookLog.Warnf("Ascend-kata-hook: marshal trace failed: %v", err)
+		return
 	}
-	// when use ctr->containerd. the rootfs in config.json is a relative path
-	rfs := ociSpec.Root.Path
-	if !filepath.IsAbs(rfs) {
-		rfs = path.Join(state.Bundle, ociSpec.Root.Path)
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE|syscall.O_NONBLOCK|syscall.O_NOFOLLOW,
+		outputFileMode)
+	if err != nil {
+		hookLog.Warnf("Ascend-kata-hook: open trace file %s failed: %v", file, err)
+		return
 	}
-
-	ret := &containerConfig{
-		Pid:    state.Pid,
-		Rootfs: rfs,
-		Env:    ociSpec.Process.Env,
+	defer f.Close()
+	if _, err := f.Write(append(content, '\n')); err != nil {
+		hookLog.Warnf("Ascend-kata-hook: write trace file %s failed: %v", file, err)
 	}
-
-	return ret, nil
 }
 
-func getValueByKey(data []string, name string) string {
-	for _, s := range data {
-		p := strings.SplitN(s, "=", 2)
-		if len(p) != kvPairSize {
-			log.Panicln("environment error")
-		}
+func (t *hookTracer) spanJSON(span traceSpan, parentID string) map[string]interface{} {
+	// status codes and span kind of OTLP
+	const statusOk, statusError, kindInternal = 1, 2, 1
+	status := map[string]interface{}{"code": statusOk}
+	if span.err != nil {
+		status = map[string]interface{}{"code": statusError, "message": span.err.Error()}
+	}
+	result := map[string]interface{}{
+		"traceId":           t.traceID,
+		"spanId":            span.spanID,
+		"name":              span.name,
+		"kind":              kindInternal,
+		"startTimeUnixNano": strconv.FormatInt(span.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(span.end.UnixNano(), 10),
+		"status":            status,
+	}
+	if parentID != "" {
+		result["parentSpanId"] = parentID
+	}
+	return result
+}
 
-		if p[0] == name && len(p) == kvPairSize {
-			return p[1]
-		}
+func isHex(s string, length int) bool {
+	if len(s) != length || strings.Trim(s, "0") == "" {
+		return false
 	}
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
 
-	return ""
+func randomHex(size int) string {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		// ids only need to be unique, the time is good enough when there is no random source
+		now := strconv.FormatInt(time.Now().UnixNano(), 16)
+		return fmt.Sprintf("%0*s", size*2, now)
+	}
+	return hex.EncodeToString(b)
 }
 
-func readMountConfig(dir string, name string) ([]string, []string, error) {
-	configFileName := fmt.Sprintf("%s.%s", name, configFileSuffix)
-	baseConfigFilePath, err := filepath.Abs(filepath.Join(dir, configFileName))
+// writeMountRecord writes the mounted host paths to mountRecordFile in the rootfs,
+// so that the tools in the container can tell what is injected by the hook
+func writeMountRecord(rootfs string, cfg *hookConfig) error {
+	record := struct {
+		FileMounts []mountEntry `json:"fileMounts"`
+		DirMounts  []mountEntry `json:"dirMounts"`
+	}{FileMounts: cfg.FileMounts, DirMounts: cfg.DirMounts}
+	content, err := json.MarshalIndent(record, "", "    ")
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to assemble base config file path: %v", err)
+		return fmt.Errorf("failed to marshal mount record: %v", err)
 	}
 
-	fileInfo, err := os.Stat(baseConfigFilePath)
-	if _, err := mindxcheckutils.RealFileChecker(baseConfigFilePath, true, false,
-		mindxcheckutils.DefaultSize); err != nil {
-		return nil, nil, err
+	dest, err := securejoin.SecureJoin(rootfs, mountRecordFile)
+	if err != nil {
+		return fmt.Errorf("join mount record parent: %s, child: %s with err %v", rootfs, mountRecordFile, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create dir of mount record %s: %v", dest, err)
+	}
+	if err := writeFileAtomic(dest, content); err != nil {
+		return fmt.Errorf("failed to write mount record %s: %v", dest, err)
 	}
+	return nil
+}
+
+// writeFileAtomic writes the content to a temp file beside file and renames it to file, so that a reader
+// sees either the old or the whole new content. the rename replaces a symlink placed at file instead of
+// writing through it, and the file gets outputFileMode regardless of the umask
+func writeFileAtomic(file string, content []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+"-")
 	if err != nil {
-		return nil, nil, fmt.Errorf("cannot stat base configuration file %s : %v", baseConfigFilePath, err)
+		return err
+	}
+	tempFile := f.Name()
+	defer os.Remove(tempFile)
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(outputFileMode); err != nil {
+		f.Close()
+		return err
 	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, file)
+}
 
-	if !fileInfo.Mode().IsRegular() {
-		return nil, nil, fmt.Errorf("base configuration file damaged because is not a regular file")
+// parseOutputMode parses the octal permission of the output files, which can not be writable or
+// executable by others than the owner
+func parseOutputMode(mode string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value&^maxOutputMode != 0 {
+		return 0, fmt.Errorf("invalid output mode %q, it should be an octal mode within %o", mode, maxOutputMode)
 	}
+	return os.FileMode(value), nil
+}
 
-	f, err := os.Open(baseConfigFilePath)
+// loadHookDefaults loads the node-level defaults of the hook, each line is <flag name>=<value> or
+// log-level=<debug|info|warn|error>, empty lines and lines starting with # are ignored. no defaults
+// are loaded when the file does not exist
+func loadHookDefaults(file string) (map[string]string, error) {
+	defaults := make(map[string]string)
+	if _, err := os.Lstat(file); os.IsNotExist(err) {
+		return defaults, nil
+	}
+	f, err := openCheckedFile(file)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open base configuration file %s: %v", baseConfigFilePath, err)
+		return nil, fmt.Errorf("check hook config %s failed: %w", file, err)
 	}
 	defer f.Close()
-
-	fileMountList, dirMountList := make([]string, 0), make([]string, 0)
-	const maxEntryNumber = 128
-	entryCount := 0
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		mountPath := scanner.Text()
-		entryCount = entryCount + 1
-		if entryCount > maxEntryNumber {
-			return nil, nil, fmt.Errorf("mount list too long")
+	const maxDefaultsSize = 64 * 1024
+	content, err := ioutil.ReadAll(io.LimitReader(f, maxDefaultsSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", file, err)
+	}
+	if len(content) > maxDefaultsSize {
+		return nil, fmt.Errorf("%s exceeds the limit of %d bytes", file, maxDefaultsSize)
+	}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
-		absMountPath, err := filepath.Abs(mountPath)
-		if err != nil {
-			continue // skipping files/dirs with any problems
+		key, value, found := strings.Cut(line, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !found || key == "" {
+			return nil, fmt.Errorf("line %d of %s should be <name>=<value>", i+1, file)
 		}
-		mountPath = absMountPath
-
-		stat, err := os.Stat(mountPath)
-		if err != nil {
-			continue // skipping files/dirs with any problems
+		defaults[key] = value
+	}
+	if level, ok := defaults[logLevelKey]; ok {
+		if _, err := parseLogLevel(level); err != nil {
+			return nil, fmt.Errorf("invalid %s in %s: %v", logLevelKey, file, err)
 		}
-
-		if stat.Mode().IsRegular() {
-			fileMountList = append(fileMountList, mountPath)
-		} else if stat.Mode().IsDir() {
-			dirMountList = append(dirMountList, mountPath)
+	}
+	if minFree, ok := defaults[logMinFreeKey]; ok {
+		if value, err := strconv.ParseInt(minFree, 10, 32); err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid %s in %s, it should be a non-negative number of MB", logMinFreeKey, file)
 		}
 	}
-
-	return fileMountList, dirMountList, nil
+	return defaults, nil
 }
 
-func readConfigsOfDir(dir string, configs []string) ([]string, []string, error) {
-	fileInfo, err := os.Stat(dir)
-	if err != nil {
-		return nil, nil, fmt.Errorf("cannot stat configuration directory %s : %v", dir, err)
+func parseLogLevel(level string) (int, error) {
+	levels := map[string]int{"debug": debugLevel, "info": infoLevel, "warn": warnLevel, "error": errorLevel}
+	if value, ok := levels[level]; ok {
+		return value, nil
 	}
+	return infoLevel, fmt.Errorf("unknown log level %q", level)
+}
 
-	if !fileInfo.Mode().IsDir() {
-		return nil, nil, fmt.Errorf("%s should be a dir for ascend docker runtime, but now it is not", dir)
+// applyHookDefaults sets the flags by the node-level defaults before the arguments are parsed,
+// so that the arguments still take precedence. the flags choosing a one-off mode can not be defaulted
+func applyHookDefaults(flags *flag.FlagSet) error {
+	oneOff := map[string]struct{}{"dump": {}, "state": {}, "replay": {}, "validate-config": {}, "generate-config": {}}
+	for key, value := range hookDefaults {
+		if key == logLevelKey || key == logMinFreeKey {
+			continue
+		}
+		if _, ok := oneOff[key]; ok || flags.Lookup(key) == nil {
+			return fmt.Errorf("%s can not be set in %s", key, hookDefaultsPath)
+		}
+		if err := flags.Set(key, value); err != nil {
+			return fmt.Errorf("invalid %s in %s: %v", key, hookDefaultsPath, err)
+		}
 	}
+	return nil
+}
 
-	fileMountList := make([]string, 0)
-	dirMountList := make([]string, 0)
+// checkFlagValues makes sure the values of the flags set by the arguments or hook.conf only contain letters,
+// digits and flagValueWhiteList, the values are checked one by one so that the separators they need are allowed
+func checkFlagValues(flags *flag.FlagSet) error {
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		if err != nil || value == "" {
+			return
+		}
+		if !mindxcheckutils.StringChecker(value, 0, maxCommandLength, flagValueWhiteList) {
+			err = fmt.Errorf("invalid value of -%s, it can only contain letters, digits and %s", f.Name,
+				flagValueWhiteList)
+		}
+	})
+	return err
+}
 
-	for _, config := range configs {
-		fileList, dirList, err := readMountConfig(dir, config)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to process config %s: %v", config, err)
+// parseFlags parses the hook's own arguments, the container state is read from stdin unless -state is given.
+// the hook only takes flags, any other argument is an error with the usage instead of being ignored
+func parseFlags(args []string) error {
+	flags := flag.NewFlagSet(hookName, flag.ContinueOnError)
+	flags.SetOutput(flagOutput)
+	flags.Int64Var(&maxStateSize, "max-state-size", defaultMaxStateSize,
+		"max size in bytes of the container state read from stdin")
+	flags.BoolVar(&skipWithoutNpu, "skip-without-npu", false,
+		"succeed without any setup when the node has neither ascend device nor driver")
+	flags.BoolVar(&dumpMode, "dump", false,
+		"print the effective configuration as JSON without setting up the container")
+	flags.BoolVar(&mountDriverLibs, "mount-driver-libs", false,
+		"mount all the libraries of the installed driver besides the mount configs")
+	flags.StringVar(&envPrefix, "env-prefix", "",
+		"look up the prefixed ascend variables first, e.g. MINDSPORE_ for MINDSPORE_ASCEND_VISIBLE_DEVICES")
+	flags.StringVar(&deviceGroup, "device-group", "",
+		"group name or gid owning the device nodes created in the container")
+	flags.BoolVar(&generateConfig, "generate-config", false,
+		"print a suggested base.list for the driver installed on the node, stdin is not read and nothing is changed")
+	flags.StringVar(&validateConfigPath, "validate-config", "",
+		"check the mount config file and report how its entries would be mounted, stdin is not read")
+	flags.StringVar(&mountSymlinkMode, "mount-symlink", symlinkFollow,
+		"how the symlinks in mount configs are handled: follow, resolve or reject")
+	flags.StringVar(&emptyMountsMode, "empty-mounts", emptyMountsBase,
+		"configs used when ASCEND_RUNTIME_MOUNTS is set to empty: base or none")
+	flags.BoolVar(&recordMounts, "record-mounts", false,
+		"write the mounted host paths to "+mountRecordFile+" in the container")
+	flags.BoolVar(&setupReport, "setup-report", false,
+		"write the devices and mounts set up to "+setupReportFile+" in the container and the run log")
+	flags.BoolVar(&rejectConfigDirLink, "reject-config-dir-link", false,
+		"fail when the config dir is a symlink instead of using the dir it links to")
+	flags.DurationVar(&configDirWait, "config-dir-wait", 0,
+		"max time to wait for the config dir to appear before failing, at most "+maxConfigDirWait.String())
+	flags.StringVar(&notifyPath, "notify", "",
+		"append the container id and devices as a JSON line to this file or named pipe after a successful setup")
+	flags.StringVar(&tracePath, "trace-file", "",
+		"append the timing of the hook stages as OTLP JSON spans to this file, the trace of "+
+			traceParentEnv+" is joined when it is set")
+	flags.StringVar(&lockPath, "lock-file", "",
+		"take an exclusive lock on this file during the setup, so that the hooks of the node run one by one")
+	flags.DurationVar(&hookTimeout, "timeout", 0,
+		"max time of the whole setup, exceeding it fails the hook with the stage it has got to, 0 means no bound")
+	flags.DurationVar(&lockTimeout, "lock-timeout", defaultLockTimeout,
+		"max time to wait for the lock of -lock-file before failing")
+	outputMode := flags.String("output-mode", fmt.Sprintf("%04o", defaultOutputMode),
+		fmt.Sprintf("octal permission of the files created by -record-mounts, -setup-report, -notify and -trace-file, "+
+			"within %04o", maxOutputMode))
+	flags.BoolVar(&useSpecDevices, "spec-devices", false,
+		"set up the container when "+ascendVisibleDevices+" is unset but the spec allows an ascend device")
+	flags.BoolVar(&mountsOnly, "mounts-only", false,
+		"mount the configs without creating devices when "+ascendRuntimeMounts+" is set but "+
+			ascendVisibleDevices+" is not")
+	flags.StringVar(&emptySetupMode, "empty-setup", emptySetupProceed,
+		"what to do when there is neither mount nor davinci device: proceed, skip or error")
+	flags.BoolVar(&strictEnv, "strict-env", false,
+		"fail when a legacy env name is set to another value than its canonical variable instead of warning")
+	flags.StringVar(&unknownOptionsMode, "unknown-runtime-options", unknownOptionsStrict,
+		"how the unknown options of "+ascendRuntimeOptions+" are handled: strict fails the hook, lenient drops "+
+			"them and passthrough keeps them in the resolved config")
+	flags.BoolVar(&sortRuntimeOptions, "sort-runtime-options", false,
+		"sort the runtime options of the container into a canonical order instead of keeping the order given")
+	flags.BoolVar(&requireAscend, "require-ascend", false,
+		"fail when the container has no ascend device to set up instead of doing nothing, for the nodes "+
+			"where every container is expected to get devices")
+	envAllowlist := flags.String("env-allowlist", "",
+		"comma separated container variables the hook reads, all of "+strings.Join(containerEnvNames, ",")+" by default")
+	flags.IntVar(&maxDevices, "max-devices", 0,
+		"max davinci devices a container gets, more devices fail the hook, 0 means no quota")
+	flags.IntVar(&maxMounts, "max-mounts", defaultMaxMounts,
+		"max mounts of all the mount configs together, more mounts fail the hook")
+	flags.BoolVar(&strictMounts, "strict-mounts", false,
+		"fail when several mount entries resolve to the same path instead of using the first one")
+	flags.DurationVar(&devScanTimeout, "dev-scan-timeout", defaultDevScanTimeout,
+		"max time to scan /dev for the device nodes")
+	flags.IntVar(&devScanMaxEntries, "dev-scan-max", defaultDevScanMaxEntries,
+		"max entries in /dev, more entries fail the scan")
+	majors := flags.String("device-majors", "",
+		"comma separated majors of the ascend devices, detected from the davinci nodes under /dev by default")
+	flags.StringVar(&driverVersionCheck, "driver-version-check", versionCheckOff,
+		"compare the driver version of the mounts with the installed driver: off, warn or error")
+	flags.StringVar(&cwdCheck, "cwd-check", versionCheckOff,
+		"check the cwd of the container process is a dir in the rootfs before the setup: off, warn or error")
+	flags.BoolVar(&useSyslog, "syslog", false,
+		"write the run log to syslog with tag "+syslogTag+" besides the log file")
+	managers := flags.String("device-managers", defaultDeviceManagers,
+		"comma separated device manager nodes under /dev created besides the davinci devices")
+	flags.StringVar(&mountConfigDir, "config-dir", configDir, "dir of the mount configs")
+	configDirs := flags.String("allowed-config-dirs", "",
+		"comma separated config dirs the containers can choose by "+ascendConfigDir+" instead of -config-dir")
+	flags.StringVar(&stateFilePath, "state", "", "read the container state from this file instead of stdin")
+	flags.StringVar(&replayStatePath, "replay", "",
+		"run every stage against the captured state file and print the result, the container is left untouched")
+	if err := applyHookDefaults(flags); err != nil {
+		return err
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
 		}
+		return fmt.Errorf("%v, run with -h for the usage", err)
+	}
+	if err := checkFlagValues(flags); err != nil {
+		return err
+	}
+	// kata-agent runs the guest hooks with the hook type as the only argument
+	if flags.NArg() > 0 && (flags.NArg() != 1 || flags.Arg(0) != guestHookType) {
+		return fmt.Errorf("unexpected arguments %q, the hook only takes flags and %s, run with -h for the usage",
+			flags.Args(), guestHookType)
+	}
 
-		fileMountList = append(fileMountList, fileList...)
-		dirMountList = append(dirMountList, dirList...)
+	if mountSymlinkMode != symlinkFollow && mountSymlinkMode != symlinkResolve && mountSymlinkMode != symlinkReject {
+		return fmt.Errorf("invalid mount symlink mode %s", mountSymlinkMode)
+	}
+	if emptyMountsMode != emptyMountsBase && emptyMountsMode != emptyMountsNone {
+		return fmt.Errorf("invalid empty mounts mode %s", emptyMountsMode)
+	}
+	if emptySetupMode != emptySetupProceed && emptySetupMode != emptySetupSkip && emptySetupMode != emptySetupError {
+		return fmt.Errorf("invalid empty setup mode %s", emptySetupMode)
+	}
+	if maxDevices < 0 {
+		return fmt.Errorf("invalid max devices %d, it should not be negative", maxDevices)
+	}
+	if maxMounts <= 0 {
+		return fmt.Errorf("invalid max mounts %d, it should be positive", maxMounts)
+	}
+	if lockTimeout <= 0 {
+		return fmt.Errorf("invalid lock timeout %v, it should be positive", lockTimeout)
+	}
+	if hookTimeout < 0 {
+		return fmt.Errorf("invalid timeout %v, it should not be negative", hookTimeout)
+	}
+	if configDirWait < 0 || configDirWait > maxConfigDirWait {
+		return fmt.Errorf("invalid config dir wait %v, it should be between 0 and %v", configDirWait, maxConfigDirWait)
+	}
+	if driverVersionCheck != versionCheckOff && driverVersionCheck != versionCheckWarn &&
+		driverVersionCheck != versionCheckError {
+		return fmt.Errorf("invalid driver version check mode %s", driverVersionCheck)
+	}
+	if cwdCheck != versionCheckOff && cwdCheck != versionCheckWarn && cwdCheck != versionCheckError {
+		return fmt.Errorf("invalid cwd check mode %s", cwdCheck)
+	}
+	if unknownOptionsMode != unknownOptionsStrict && unknownOptionsMode != unknownOptionsLenient &&
+		unknownOptionsMode != unknownOptionsPassthrough {
+		return fmt.Errorf("invalid unknown runtime options mode %s", unknownOptionsMode)
+	}
+	var err error
+	if deviceManagerNames, err = parseDeviceManagers(*managers); err != nil {
+		return err
+	}
+	if allowedEnvNames, err = parseEnvAllowlist(*envAllowlist); err != nil {
+		return err
+	}
+	if allowedConfigDirs, err = parseConfigDirs(*configDirs); err != nil {
+		return err
+	}
+	if deviceMajors, err = parseDeviceMajors(*majors); err != nil {
+		return err
+	}
+	if outputFileMode, err = parseOutputMode(*outputMode); err != nil {
+		return err
+	}
+	if envAliases, err = loadEnvAliases(filepath.Join(mountConfigDir, envAliasFile)); err != nil {
+		return err
+	}
+	if replayStatePath != "" {
+		if stateFilePath != "" {
+			return fmt.Errorf("-replay and -state can not be used together")
+		}
+		stateFilePath = replayStatePath
 	}
+	if stateFilePath == "" {
+		return nil
+	}
+	realPath, err := mindxcheckutils.RealFileChecker(stateFilePath, false, false, mindxcheckutils.DefaultSize)
+	if err != nil {
+		return fmt.Errorf("check state file %s failed: %v", stateFilePath, err)
+	}
+	stateFile, err := os.Open(realPath)
+	if err != nil {
+		return fmt.Errorf("failed to open state file %s: %v", stateFilePath, err)
+	}
+	containerConfigInputStream = stateFile
+	return nil
+}
 
-	return fileMountList, dirMountList, nil
+// recoverPanic logs the panic of the hook with its stack to the run log and stderr and exits with panicExitCode,
+// the modes of the log files are restored by the changeLogMode deferred after it in main. the panic is raised
+// again for a core dump when ASCEND_HOOK_REPANIC of the hook's env is true
+func recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	stack := debug.Stack()
+	if p, ok := r.(*setupPanic); ok {
+		r, stack = p.value, p.stack
+	}
+	// stderr goes first, it is there even when the panic comes before the run log is ready
+	log.Printf("panic: %v\n%s", r, stack)
+	hookLog.Errorf("Ascend-kata-hook: panic: %v\n%s", r, stack)
+	if os.Getenv(ascendHookRepanic) == "true" {
+		panic(r)
+	}
+	exitHook(panicExitCode)
 }
 
-func getArgs(cliPath string, containerConfig *containerConfig, fileMountList []string,
-	dirMountList []string, allowLink string) []string {
-	args := append([]string{cliPath},
-		"--allow-link", allowLink, "--pid", fmt.Sprintf("%d", containerConfig.Pid),
-		"--rootfs", containerConfig.Rootfs)
-	for _, filePath := range fileMountList {
-		args = append(args, "--mount-file", filePath)
+func changeLogMode() {
+	if err := mindxcheckutils.ChangeRuntimeLogMode("hook-run-"); err != nil {
+		fmt.Println("defer changeFileMode function failed")
 	}
-	for _, dirPath := range dirMountList {
-		args = append(args, "--mount-dir", dirPath)
-	}
-	return args
 }
 
-func doPrestartHook() error {
-	containerConfig, err := getContainerConfig()
+func main() {
+	defer recoverPanic()
+	log.SetPrefix(loggingPrefix)
+
+	// the defaults are loaded before the log so that they can set the log level
+	defaults, err := loadHookDefaults(hookDefaultsPath)
 	if err != nil {
-		return fmt.Errorf("failed to get container config: %#v", err)
+		log.Fatal(err)
 	}
-
-	if visibleDevices := getValueByKey(containerConfig.Env, ascendVisibleDevices); visibleDevices == "" {
-		hwlog.RunLog.Infof("Ascend-kata-hook: hasn't ascend device: %#v", ascendVisibleDevices)
-		return nil
+	hookDefaults = defaults
+	if level, ok := hookDefaults[logLevelKey]; ok {
+		runLogLevel, _ = parseLogLevel(level)
 	}
 
-	hwlog.RunLog.Infof("Ascend-kata-hook: has ascend device define: %#v", ascendVisibleDevices)
-	if err := setEnv(*containerConfig); err != nil {
-		return err
+	// the run log goes to stderr instead of the log file when the disk of the log is nearly full
+	if minFree, ok := hookDefaults[logMinFreeKey]; ok {
+		value, _ := strconv.ParseInt(minFree, 10, 32)
+		if err := checkLogSpace(filepath.Dir(runLogPath), value*oneMegabyte); err != nil {
+			log.Printf("the run log is written to stderr: %v", err)
+			hookLog.fallback = os.Stderr
+		}
 	}
-	mountConfigs := parseMounts(getValueByKey(containerConfig.Env, ascendRuntimeMounts))
-
-	fileMountList, dirMountList, err := readConfigsOfDir(configDir, mountConfigs)
+	ctx, _ := context.WithCancel(context.Background())
+	if hookLog.fallback == nil {
+		if err := initLogModule(ctx); err != nil {
+			log.Fatal(err)
+		}
+	}
+	logPrefixWords, err := mindxcheckutils.GetLogPrefix()
 	if err != nil {
-		return fmt.Errorf("failed to read configuration from config directory: %#v", err)
+		log.Fatal(err)
 	}
-
-	for _, file := range fileMountList {
-		if _, err := os.Stat(file); err != nil {
-			return fmt.Errorf("mount file %s doesn't exist on host", file)
+	defer changeLogMode()
+	hookLog.Infof("%v ascend docker hook starting, try to setup container", logPrefixWords)
+	if err := parseFlags(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
 		}
-
-		dest, err := securejoin.SecureJoin(containerConfig.Rootfs, file)
-		if err != nil {
-			return fmt.Errorf("join file parent: %s, child: %s, with err %v", containerConfig.Rootfs, file, err)
+		hookLog.Errorf("%v ascend docker hook failed: %v", logPrefixWords, err)
+		log.Fatal(err)
+	}
+	if useSyslog {
+		initSyslog()
+	}
+	if generateConfig {
+		if err := generateMountConfig(os.Stdout); err != nil {
+			hookLog.Errorf("%v generate mount config failed: %v", logPrefixWords, err)
+			log.Fatal(err)
 		}
-		err = bindMountFile(containerConfig.Rootfs, dest, file)
-		if err != nil {
-			return fmt.Errorf("bind mount file source: %s, dest: %s with err %v", file, dest, err)
+		return
+	}
+	if validateConfigPath != "" {
+		if err := validateMountConfig(validateConfigPath, os.Stdout); err != nil {
+			hookLog.Errorf("%v validate mount config failed: %v", logPrefixWords, err)
+			log.Fatal(err)
 		}
+		return
 	}
-
-	for _, dir := range dirMountList {
-		if _, err := os.Stat(dir); err != nil {
-			return fmt.Errorf("mount dir %s doesn't exist on host", dir)
+	if replayStatePath != "" {
+		if err := replayHook(os.Stdout); err != nil {
+			hookLog.Errorf("%v replay hook failed: %v", logPrefixWords, err)
+			log.Fatal(err)
 		}
-
-		dest, err := securejoin.SecureJoin(containerConfig.Rootfs, dir)
-		if err != nil {
-			return fmt.Errorf("join file parent: %s, child: %s with err %v", containerConfig.Rootfs, dir, err)
+		return
+	}
+	if dumpMode {
+		if err := dumpHookConfig(); err != nil {
+			hookLog.Errorf("%v dump hook config failed: %v", logPrefixWords, err)
+			log.Fatalf("failed to dump hook config: %v", err)
 		}
-		err = bindMountDir(containerConfig.Rootfs, dest, dir)
+		return
+	}
+	if tracePath != "" {
+		tracer = newHookTracer(os.Getenv(traceParentEnv))
+	}
+	if lockPath != "" {
+		unlock, err := acquireNodeLock(lockPath)
 		if err != nil {
-			return fmt.Errorf("bind mount dir source: %s, dest: %s with err %v", dir, dest, err)
+			hookLog.Errorf("%v ascend docker hook failed: %v", logPrefixWords, err)
+			log.Fatal(err)
 		}
+		defer unlock()
 	}
-
-	if err := mountDev(*containerConfig); err != nil {
-		return err
+	err = runWithTimeout(doPrestartHook, hookTimeout)
+	tracer.finish(tracePath, err)
+	if err != nil {
+		// %v keeps the messages of the wrapped errors, %#v only prints the struct of the outermost one
+		hookLog.Errorf("%v ascend docker hook failed: %v", logPrefixWords, err)
+		log.Fatalf("ascend docker hook failed to setup the container: %v", err)
 	}
-
-	return nil
 }
 
-func main() {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Fatal(err)
-		}
-	}()
-	log.SetPrefix(loggingPrefix)
-
-	ctx, _ := context.WithCancel(context.Background())
-	if err := initLogModule(ctx); err != nil {
-		log.Fatal(err)
+// hasAscendHardware checks whether the node has any davinci device or the ascend driver installed
+func hasAscendHardware() bool {
+	if _, err := os.Stat(ascendDriverPath); err == nil {
+		return true
 	}
-	logPrefixWords, err := mindxcheckutils.GetLogPrefix()
+	devFiles, err := readDevDir(hostDevPath)
 	if err != nil {
-		log.Fatal(err)
+		hookLog.Warnf("Ascend-kata-hook: get %s error %v", hostDevPath, err)
+		return false
 	}
-	defer func() {
-		if err := mindxcheckutils.ChangeRuntimeLogMode("hook-run-"); err != nil {
-			fmt.Println("defer changeFileMode function failed")
+	for _, devFile := range devFiles {
+		if strings.HasPrefix(devFile, "davinci") {
+			return true
 		}
-	}()
-	hwlog.RunLog.Infof("%v ascend docker hook starting, try to setup container", logPrefixWords)
-	if !mindxcheckutils.StringChecker(strings.Join(os.Args, " "), 0,
-		maxCommandLength, mindxcheckutils.DefaultWhiteList+" ") {
-		hwlog.RunLog.Errorf("%v ascend docker hook failed", logPrefixWords)
-		log.Fatal("command error")
-	}
-	if err := doPrestartHook(); err != nil {
-		hwlog.RunLog.Errorf("%v ascend docker hook failed: %#v", logPrefixWords, err)
-		log.Fatal(fmt.Errorf("failed in runtime.doProcess: %#v", err))
 	}
+	return false
 }
 
 // check if file exist or not
 func hasFile(file string, pid int) bool {
 
 	if err := os.Setenv("PATH", "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"); err != nil {
-		hwlog.RunLog.Errorf("set env err:%v", err)
+		hookLog.Errorf("set env err:%v", err)
 	}
 
 	cmd := exec.Command("nsenter",
@@ -437,17 +3492,17 @@ func hasFile(file string, pid int) bool {
 	)
 	output, errs := cmd.CombinedOutput()
 	if errs != nil {
-		hwlog.RunLog.Errorf("Ascend-kata-hook: exec cmd: %s, err: %s ", cmd.String(), output)
+		hookLog.Errorf("Ascend-kata-hook: exec cmd: %s, err: %s ", cmd.String(), output)
 		return false
 	}
-	hwlog.RunLog.Infof("Ascend-kata-hook: hasRootfs ture, return: %s", output)
+	hookLog.Infof("Ascend-kata-hook: hasRootfs ture, return: %s", output)
 	return true
 }
 
 // createDeviceNode creates the file under /dev in container.
 // firstly try to mknod the device.
 // bind mount will be executed when mknod in error
-func createDeviceNode(rootfs string, dev string, pid int) error {
+func createDeviceNode(rootfs string, dev string, pid int, gid int) error {
 	device, err := oci.DeviceFromPath(dev)
 	if err != nil {
 		return err
@@ -463,20 +3518,24 @@ func createDeviceNode(rootfs string, dev string, pid int) error {
 		if err != nil {
 			return err
 		}
-		hwlog.RunLog.Infof("Ascend-kata-hook: rootfs exists, dest is: %s", dest)
+		hookLog.Infof("Ascend-kata-hook: rootfs exists, dest is: %s", dest)
 
 	}
-	hwlog.RunLog.Infof("Ascend-kata-hook: ----dest----: %s", dest)
+	hookLog.Infof("Ascend-kata-hook: ----dest----: %s", dest)
 
 	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
 		return err
 	}
 
-	if err := mknodDeviceNode(dest, *device, pid); err != nil {
+	if err := mknodDeviceNode(dest, *device, pid, gid); err != nil {
 		if errors.Is(err, os.ErrExist) {
 			return nil
 		} else if errors.Is(err, os.ErrPermission) {
-			hwlog.RunLog.Infof("Ascend-kata-hook: mknodDevice failed with err:%v bindmount instead", err)
+			hookLog.Infof("Ascend-kata-hook: mknodDevice failed with err:%v bindmount instead", err)
+			if gid >= 0 {
+				// the bind mounted node is the host's one, its group should never be changed
+				hookLog.Warnf("Ascend-kata-hook: device group is not applied to bind mounted %s", dest)
+			}
 			return bindMountDeviceNode(rootfs, dest, *device)
 		}
 		return err
@@ -492,21 +3551,22 @@ func createDeviceNode(rootfs string, dev string, pid int) error {
 //	nsenter --target 128 --mount mknod /dev/davinci_manager c 245 0
 //
 // other more, the hook executes before chroot, the dev location
-// must be the full path of rootfs
-func mknodDeviceNode(dest string, device specs.LinuxDevice, pid int) error {
+// must be the full path of rootfs.
+// the node is given to the group gid with group read and write permission when gid is not negative
+func mknodDeviceNode(dest string, device specs.LinuxDevice, pid int, gid int) error {
 	if device.Type != "c" {
 		return fmt.Errorf("Do not support to mount device type: %s", device.Type)
 	}
 
 	//make sure all binaries are under PATH.
 	if err := os.Setenv("PATH", "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"); err != nil {
-		hwlog.RunLog.Errorf("set env err:%v", err)
+		hookLog.Errorf("set env err:%v", err)
 		return err
 	}
 
 	devExists := hasFile(dest, pid)
 	if devExists {
-		hwlog.RunLog.Warnf("Ascend-kata-hook: mknod target already exists.")
+		hookLog.Warnf("Ascend-kata-hook: mknod target already exists.")
 		return nil
 	}
 
@@ -522,20 +3582,44 @@ func mknodDeviceNode(dest string, device specs.LinuxDevice, pid int) error {
 	)
 	output, errs := cmd.CombinedOutput()
 	if errs != nil {
-		hwlog.RunLog.Errorf("Ascend-kata-hook: exec cmd: %s, err: %s ", cmd.String(), output)
+		hookLog.Errorf("Ascend-kata-hook: exec cmd: %s, err: %s ", cmd.String(), output)
 		return fmt.Errorf("Ascend-kata-hook: Mknod err: %v", errs)
 	}
+	if gid >= 0 {
+		return setDeviceNodeGroup(dest, pid, gid)
+	}
+	return nil
+}
+
+// setDeviceNodeGroup changes the group of the device node in container and grants the group read and write
+func setDeviceNodeGroup(dest string, pid int, gid int) error {
+	commands := [][]string{
+		{"chgrp", strconv.Itoa(gid), dest},
+		{"chmod", "g+rw", dest},
+	}
+	for _, command := range commands {
+		cmd := exec.Command("nsenter", append([]string{"--target", strconv.Itoa(pid), "--mount"}, command...)...)
+		output, errs := cmd.CombinedOutput()
+		if errs != nil {
+			hookLog.Errorf("Ascend-kata-hook: exec cmd: %s, err: %s ", cmd.String(), output)
+			return fmt.Errorf("Ascend-kata-hook: set group of %s err: %v", dest, errs)
+		}
+	}
 	return nil
 }
 
 // bindMountDeviceNode creates the rootfs/dev/xxx
 func bindMountDeviceNode(rootfs string, dest string, device specs.LinuxDevice) error {
-	return bindMountFile(rootfs, dest, device.Path)
+	return bindMountFile(rootfs, dest, device.Path, "")
 
 }
 
 // bindMountFile creates and mount file from host to container
-func bindMountFile(rootfs string, dest string, source string) error {
+func bindMountFile(rootfs string, dest string, source string, propagation string) error {
+	// the parent may not exist in the container when a dir mount is split for exclusions
+	if err := os.MkdirAll(filepath.Dir(dest), 0550); err != nil {
+		return err
+	}
 	f, err := os.Create(dest)
 	if err != nil && !os.IsExist(err) {
 		return err
@@ -543,42 +3627,115 @@ func bindMountFile(rootfs string, dest string, source string) error {
 	if f != nil {
 		_ = f.Close()
 	}
-	return bindMount(rootfs, dest, source)
+	return bindMount(rootfs, dest, source, propagation)
+}
+
+// checkRootfsWritable makes sure the files can be copied into the rootfs, which fails on a read-only root
+func checkRootfsWritable(rootfs string) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(rootfs, &stat); err != nil {
+		return fmt.Errorf("cannot stat the file system of rootfs %s: %v", rootfs, err)
+	}
+	if stat.Flags&unix.ST_RDONLY != 0 {
+		return fmt.Errorf("rootfs %s is read-only, the entries marked copy can not be copied into it", rootfs)
+	}
+	if err := unix.Access(rootfs, unix.W_OK); err != nil {
+		return fmt.Errorf("rootfs %s is not writable, the entries marked copy can not be copied into it: %v",
+			rootfs, err)
+	}
+	return nil
+}
+
+// copyFile copies the small file from host to container, the content is a snapshot taken at the setup
+// so that the container does not depend on the host file afterwards
+func copyFile(dest string, source string) error {
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || info.Size() > maxCopySize {
+		return fmt.Errorf("only regular files no larger than %d bytes can be copied", maxCopySize)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(src, maxCopySize+1))
+	if err != nil {
+		return err
+	}
+	if len(content) > maxCopySize {
+		return fmt.Errorf("%s grows over %d bytes while being copied", source, maxCopySize)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0550); err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(content); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
 }
 
 // bindMountDir creates dirctory and mount dir
-func bindMountDir(rootfs string, dest string, source string) error {
+func bindMountDir(rootfs string, dest string, source string, propagation string) error {
 	err := os.MkdirAll(dest, 0550)
 	if err != nil {
 		return err
 	}
-	return bindMount(rootfs, dest, source)
+	return bindMount(rootfs, dest, source, propagation)
 }
 
-// bindMount create the dest via bind mount the host path
-func bindMount(rootfs string, dest string, source string) error {
-	return utils.WithProcfd(rootfs, dest, func(dstFd string) error {
+// bindMount create the dest via bind mount the host path,
+// the propagation of the mount is changed when a propagation mode is given
+func bindMount(rootfs string, dest string, source string, propagation string) error {
+	flags, ok := mountPropagations[propagation]
+	if propagation != "" && !ok {
+		return fmt.Errorf("unknown mount propagation %s", propagation)
+	}
+	if err := utils.WithProcfd(rootfs, dest, func(dstFd string) error {
+		target := dest
 		if dstFd != "" {
-			dest = dstFd
+			target = dstFd
 		}
-		unix.Mount(source, dest, "bind", unix.MS_BIND, "")
+		return doMount(source, target, "bind", unix.MS_BIND, "")
+	}); err != nil {
+		return err
+	}
+	if propagation == "" {
 		return nil
+	}
+	// the fd opened before the bind mount still refers to the covered dentry, the target is opened again so that
+	// the propagation is changed on the new mount, the same as mountPropagate of runc
+	return utils.WithProcfd(rootfs, dest, func(dstFd string) error {
+		target := dest
+		if dstFd != "" {
+			target = dstFd
+		}
+		return doMount("", target, "", flags, "")
 	})
 }
 
 // mountDeviceManger creates the 910b manager relative device.
 // notes: only be tested on 910b chip currently.
-// which include davinci_manager, hisi_hdc, devmm_svm
+// which include davinci_manager, hisi_hdc, devmm_svm by default and can be changed by -device-managers
 // Args:
 //
 //	rootfs(string): target container's rootfs path.
 //	pid(int): target container's init process id
-func mountDeviceManager(rootfs string, pid int) error {
-	dev_names := []string{"davinci_manager", "hisi_hdc", "devmm_svm"}
-
-	for _, d := range dev_names {
-		hwlog.RunLog.Infof("Ascend-kata-hook: mount dev manager %s with rootfs %s", d, rootfs)
-		if err := mountDevice(rootfs, d, pid); err != nil {
+//	gid(int): group of the created device nodes, negative to keep the default
+func mountDeviceManager(rootfs string, pid int, gid int) error {
+	if err := checkDeviceManagers(); err != nil {
+		return err
+	}
+	for _, d := range deviceManagerNames {
+		hookLog.Infof("Ascend-kata-hook: mount dev manager %s with rootfs %s", d, rootfs)
+		if err := mountDevice(rootfs, d, pid, gid); err != nil {
 			return err
 		}
 	}
@@ -591,13 +3748,14 @@ func mountDeviceManager(rootfs string, pid int) error {
 //	rootfs(string): target container's rootfs path
 //	dev(string): the full path of device in container
 //	pid(int): target container's init process id
-func mountDevice(rootfs string, dev string, pid int) error {
-	devfile := path.Join("/dev", dev)
+//	gid(int): group of the created device node, negative to keep the default
+func mountDevice(rootfs string, dev string, pid int, gid int) error {
+	devfile := path.Join(hostDevPath, dev)
 	if _, err := os.Stat(devfile); err != nil {
-		hwlog.RunLog.Errorf("Dev %s doesn't exist on host, err: %v", devfile, err)
+		hookLog.Errorf("Dev %s doesn't exist on host, err: %v", devfile, err)
 		return fmt.Errorf("Npu device manager file %s doesn't exist on host", devfile)
 	}
-	if err := createDeviceNode(rootfs, devfile, pid); err != nil {
+	if err := createDeviceNode(rootfs, devfile, pid, gid); err != nil {
 		return err
 	}
 	return nil
@@ -609,34 +3767,48 @@ func mountDevice(rootfs string, dev string, pid int) error {
 //	2)hisi_hdc
 //	3)devmm_svm
 //	4 all the davinci dev like davinci1,davinci2
-func mountDev(config containerConfig) error {
+func mountDev(config containerConfig, gid int) error {
 
-	if err := mountDeviceManager(config.Rootfs, config.Pid); err != nil {
+	if err := mountDeviceManager(config.Rootfs, config.Pid, gid); err != nil {
 		return err
 	}
 	WAIT_TOTAL_SECONDS, CHECK_PERIOD := 60, 3
 	start := time.Now()
 	has_dev := false
+	// the devices appearing while waiting count towards the quota as well
+	found := make(map[string]struct{})
 	for {
-		dev_files, err := ioutil.ReadDir("/dev")
+		dev_files, err := readDevDir(hostDevPath)
 		if err != nil {
-			hwlog.RunLog.Errorf("Ascend-kata-hook: get /dev/ error %v", err)
+			hookLog.Errorf("Ascend-kata-hook: get %s error %v", hostDevPath, err)
 			return err
 		}
+		for _, dev_file := range dev_files {
+			if strings.Contains(dev_file, "davinci") && dev_file != "davinci_manager" {
+				found[dev_file] = struct{}{}
+			}
+		}
+		if maxDevices > 0 && len(found) > maxDevices {
+			return fmt.Errorf("%d davinci devices are found for the container, the quota is %d", len(found),
+				maxDevices)
+		}
 
 		for _, dev_file := range dev_files {
-			if strings.Contains(dev_file.Name(), "davinci") {
-				if dev_file.Name() == "davinci_manager" {
+			if strings.Contains(dev_file, "davinci") {
+				if dev_file == "davinci_manager" {
 					continue
 				}
 				has_dev = true
-				err := mountDevice(config.Rootfs, dev_file.Name(), config.Pid)
+				if err := checkDeviceNode(path.Join(hostDevPath, dev_file)); err != nil {
+					return err
+				}
+				err := mountDevice(config.Rootfs, dev_file, config.Pid, gid)
 				if err != nil {
-					hwlog.RunLog.Errorf("Ascend-kata-hook: mountDevice:%s, error: %v", dev_file.Name(), err)
+					hookLog.Errorf("Ascend-kata-hook: mountDevice:%s, error: %v", dev_file, err)
 					return err
 				}
 			}
-			hwlog.RunLog.Infof("Ascend-kata-hook: get dev file %v", dev_file.Name())
+			hookLog.Infof("Ascend-kata-hook: get dev file %v", dev_file)
 		}
 
 		//wait the dev ready
@@ -648,7 +3820,7 @@ func mountDev(config containerConfig) error {
 
 	}
 	if !has_dev {
-		hwlog.RunLog.Errorf("Ascend-kata-hook: timeout to find /dev/davinci*")
+		hookLog.Errorf("Ascend-kata-hook: timeout to find %s/davinci*", hostDevPath)
 	}
 	return nil
 }
@@ -658,7 +3830,7 @@ func setEnv(config containerConfig) error {
 	env_file := path.Join(config.Rootfs, "/root/.bashrc")
 	f, err := os.OpenFile(env_file, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0660)
 	if err != nil {
-		hwlog.RunLog.Errorf("Ascend-kata-hook: Cannot open evn file %s, err: %v\n", env_file, err)
+		hookLog.Errorf("Ascend-kata-hook: Cannot open evn file %s, err: %v\n", env_file, err)
 		return err
 	}
 	defer f.Close()
@@ -16,10 +16,22 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/prashantv/gostub"
+	"golang.org/x/sys/unix"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 const (
@@ -190,3 +202,2266 @@ func TestGetContainerConfig(t *testing.T) {
 
 	getContainerConfig()
 }
+
+func TestGetContainerConfigCase2(t *testing.T) {
+	file := "state.json"
+	if err := os.WriteFile(file, []byte(`{"ociVersion":"1.0.2","pid":123,"bundle":"/tmp"}`), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	defer os.Remove(file)
+	stateFile, err := os.Open(file)
+	if err != nil {
+		t.Fatal("open file failed")
+	}
+	defer stateFile.Close()
+
+	stub := gostub.Stub(&containerConfigInputStream, stateFile)
+	defer stub.Reset()
+	stub.Stub(&maxStateSize, int64(16))
+
+	if _, err := getContainerConfig(); err == nil {
+		t.Fail()
+	}
+}
+
+func TestGetContainerConfigCase4(t *testing.T) {
+	file := "state.json"
+	if err := os.WriteFile(file, []byte(`{"ociVersion":"1.0.2","pid":0,"bundle":"/tmp"}`), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	defer os.Remove(file)
+	stateFile, err := os.Open(file)
+	if err != nil {
+		t.Fatal("open file failed")
+	}
+	defer stateFile.Close()
+
+	stub := gostub.Stub(&containerConfigInputStream, stateFile)
+	defer stub.Reset()
+
+	_, err = getContainerConfig()
+	if err == nil || !strings.Contains(err.Error(), "invalid pid 0") {
+		t.Fail()
+	}
+}
+
+func TestFindBundleConfigCase1(t *testing.T) {
+	bundle := t.TempDir()
+	rootfs := filepath.Join(bundle, "rootfs")
+	if err := os.Mkdir(rootfs, 0750); err != nil {
+		t.Fatal("create dir failed")
+	}
+	if _, err := findBundleConfig(rootfs); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("missing config.json should fail: %v", err)
+	}
+	// the state gives the rootfs dir as the bundle, config.json is found in its parent and is the one checked
+	configPath := filepath.Join(bundle, "config.json")
+	if err := os.WriteFile(configPath, []byte("{}"), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	checked := ""
+	stub := gostub.Stub(&checkRealFile, func(file string, _ bool, _ bool, _ int) (string, error) {
+		checked = file
+		return file, nil
+	})
+	defer stub.Reset()
+	if found, err := findBundleConfig(rootfs); err != nil || found != configPath || checked != configPath {
+		t.Errorf("config.json in the parent should be used, got %s checked %s, %v", found, checked, err)
+	}
+	stub.Stub(&checkRealFile, func(string, bool, bool, int) (string, error) {
+		return "", fmt.Errorf("owner not right")
+	})
+	if _, err := findBundleConfig(rootfs); err == nil || !strings.Contains(err.Error(), "check config.json "+configPath) {
+		t.Errorf("config.json failing the check should fail: %v", err)
+	}
+}
+
+// TestMountDevCase1 tests the devices are looked up in the dev dir of the host given by hostDevPath
+func TestMountDevCase1(t *testing.T) {
+	devDir := t.TempDir()
+	stub := gostub.Stub(&hostDevPath, devDir)
+	defer stub.Reset()
+	stub.Stub(&deviceManagerNames, []string{})
+	stub.Stub(&hookLog, &hookLogger{fallback: io.Discard})
+	if err := mountDevice(t.TempDir(), "davinci_manager", pidSample, -1); err == nil ||
+		!strings.Contains(err.Error(), devDir) {
+		t.Errorf("the device should be looked up in %s, got %v", devDir, err)
+	}
+	// a davinci file which is not a char device is reported before waiting for more devices
+	if err := os.WriteFile(filepath.Join(devDir, "davinci0"), nil, 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	err := mountDev(containerConfig{Pid: pidSample, Rootfs: t.TempDir()}, -1)
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(devDir, "davinci0")) {
+		t.Errorf("the device in %s should be checked, got %v", devDir, err)
+	}
+	// the quota tells how many devices are found
+	if err := os.WriteFile(filepath.Join(devDir, "davinci1"), nil, 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	stub.Stub(&maxDevices, 1)
+	err = mountDev(containerConfig{Pid: pidSample, Rootfs: t.TempDir()}, -1)
+	if err == nil || !strings.Contains(err.Error(), "2 davinci devices are found for the container, the quota is 1") {
+		t.Errorf("the quota should be exceeded by the 2 devices found, got %v", err)
+	}
+}
+
+func TestHasAscendHardwareCase1(t *testing.T) {
+	devDir := t.TempDir()
+	stub := gostub.Stub(&hostDevPath, devDir)
+	defer stub.Reset()
+	stub.Stub(&ascendDriverPath, "not-exist-driver")
+	if hasAscendHardware() {
+		t.Fail()
+	}
+	if err := os.WriteFile(devDir+"/davinci0", nil, 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	if !hasAscendHardware() {
+		t.Fail()
+	}
+}
+
+func TestDoPrestartHookCase6(t *testing.T) {
+	conCfg := containerConfig{
+		Pid:    pidSample,
+		Rootfs: ".",
+		Env:    []string{"ASCEND_VISIBLE_DEVICES=0"},
+	}
+	stub := gostub.StubFunc(&getContainerConfig, &conCfg, nil)
+	defer stub.Reset()
+	stub.Stub(&skipWithoutNpu, true)
+	stub.Stub(&hostDevPath, t.TempDir())
+	stub.Stub(&ascendDriverPath, "not-exist-driver")
+	if err := doPrestartHook(); err != nil {
+		t.Fail()
+	}
+}
+
+func TestResolveHookConfigCase1(t *testing.T) {
+	conCfg := containerConfig{
+		Pid:    pidSample,
+		Rootfs: ".",
+		Env:    []string{"ASCEND_RUNTIME_MOUNTS=base", "PATH=/usr/bin"},
+	}
+	cfg, err := resolveHookConfig(&conCfg)
+	if err != nil || cfg.Enabled {
+		t.Fail()
+	}
+	if len(cfg.Env) != 1 || cfg.Env["ASCEND_RUNTIME_MOUNTS"] != "base" {
+		t.Fail()
+	}
+}
+
+func TestResolveHookConfigCase2(t *testing.T) {
+	conCfg := containerConfig{
+		Pid:    pidSample,
+		Rootfs: ".",
+		Env:    []string{"ASCEND_VISIBLE_DEVICES=0"},
+	}
+	stub := gostub.Stub(&mountConfigDir, "not-exist-dir")
+	defer stub.Reset()
+	if _, err := resolveHookConfig(&conCfg); err == nil {
+		t.Fail()
+	}
+}
+
+func TestResolveHookConfigCase3(t *testing.T) {
+	conCfg := containerConfig{
+		Pid:    pidSample,
+		Rootfs: ".",
+		Env:    []string{"ASCEND_RUNTIME_MOUNTS=base"},
+	}
+	stub := gostub.Stub(&mountConfigDir, "not-exist-dir")
+	defer stub.Reset()
+	if cfg, err := resolveHookConfig(&conCfg); err != nil || cfg.Enabled {
+		t.Error("mounts without devices should only be warned by default")
+	}
+	// the configs are read in the mounts only mode
+	stub.Stub(&mountsOnly, true)
+	if _, err := resolveHookConfig(&conCfg); err == nil {
+		t.Fail()
+	}
+}
+
+func TestCheckDeviceQuotaCase1(t *testing.T) {
+	devDir := t.TempDir()
+	for _, name := range []string{"davinci0", "davinci1", "davinci_manager"} {
+		if err := os.WriteFile(filepath.Join(devDir, name), nil, 0600); err != nil {
+			t.Fatal("create file failed")
+		}
+	}
+	stub := gostub.Stub(&hostDevPath, devDir)
+	defer stub.Reset()
+	// no quota by default
+	if err := checkDeviceQuota(); err != nil {
+		t.Error(err)
+	}
+	stub.Stub(&maxDevices, 2)
+	if err := checkDeviceQuota(); err != nil {
+		t.Errorf("the manager should not count: %v", err)
+	}
+	stub.Stub(&maxDevices, 1)
+	if err := checkDeviceQuota(); err == nil || !strings.Contains(err.Error(), "quota is 1") {
+		t.Errorf("2 devices should exceed the quota: %v", err)
+	}
+}
+
+func TestLogResolvedConfigCase1(t *testing.T) {
+	stub := gostub.Stub(&hostDevPath, "not-exist-dev")
+	defer stub.Reset()
+	// failures to list the devices are only logged
+	logResolvedConfig(&hookConfig{FileMounts: []mountEntry{{Path: "/usr/local/bin/npu-smi"}}})
+	logResolvedConfig(&hookConfig{MountsOnly: true})
+}
+
+func TestListDeviceNodesCase1(t *testing.T) {
+	devDir := t.TempDir()
+	for _, name := range []string{"davinci_manager", "davinci0", "null"} {
+		if err := os.WriteFile(devDir+"/"+name, nil, 0600); err != nil {
+			t.Fatal("create file failed")
+		}
+	}
+	stub := gostub.Stub(&hostDevPath, devDir)
+	defer stub.Reset()
+	devices, err := listDeviceNodes()
+	if err != nil || len(devices) != 2 {
+		t.Fail()
+	}
+}
+
+func TestParseMountEntryCase1(t *testing.T) {
+	entry, err := parseMountEntry("/usr/local/Ascend/driver rslave")
+	if err != nil || entry.Path != "/usr/local/Ascend/driver" || entry.Propagation != "rslave" {
+		t.Fail()
+	}
+	entry, err = parseMountEntry("  /usr/local/dcmi  ")
+	if err != nil || entry.Path != "/usr/local/dcmi" || entry.Propagation != "" {
+		t.Fail()
+	}
+	entry, err = parseMountEntry("")
+	if err != nil || entry.Path != "" {
+		t.Fail()
+	}
+}
+
+func TestParseMountEntryCase2(t *testing.T) {
+	if _, err := parseMountEntry("/usr/local/dcmi unbindable"); err == nil {
+		t.Fail()
+	}
+	if _, err := parseMountEntry("/usr/local/dcmi rshared extra"); err == nil {
+		t.Fail()
+	}
+}
+
+func TestFindDriverLibsCase1(t *testing.T) {
+	driverDir := t.TempDir()
+	libDir := driverDir + "/lib64/common"
+	if err := os.MkdirAll(libDir, 0700); err != nil {
+		t.Fatal("create dir failed")
+	}
+	for _, name := range []string{"libc_sec.so", "libdrvdsmi_host.so"} {
+		if err := os.WriteFile(libDir+"/"+name, nil, 0600); err != nil {
+			t.Fatal("create file failed")
+		}
+	}
+	if err := os.Symlink("not-exist", libDir+"/libdangling.so"); err != nil {
+		t.Fatal("create link failed")
+	}
+	stub := gostub.Stub(&ascendInstallInfoPath, "not-exist-info")
+	defer stub.Reset()
+	stub.Stub(&ascendDriverPath, driverDir)
+	libs, err := findDriverLibs()
+	if err != nil || len(libs) != 2 {
+		t.Fail()
+	}
+	// the libraries are limited by -max-mounts and the error tells where the limit is hit
+	stub.Stub(&maxMounts, 1)
+	if _, err := findDriverLibs(); err == nil || !strings.Contains(err.Error(), libDir) {
+		t.Errorf("the libraries should be limited, got %v", err)
+	}
+}
+
+func TestMergeDriverLibsCase1(t *testing.T) {
+	fileMounts := []mountEntry{{Path: "/usr/local/Ascend/driver/lib64/libdcmi.so"}}
+	dirMounts := []mountEntry{{Path: "/usr/local/Ascend/driver/lib64/common"}}
+	libs := []string{
+		"/usr/local/Ascend/driver/lib64/libdcmi.so",
+		"/usr/local/Ascend/driver/lib64/common/libc_sec.so",
+		"/usr/local/Ascend/driver/lib64/driver/libascend_hal.so",
+	}
+	merged := mergeDriverLibs(fileMounts, dirMounts, libs)
+	if len(merged) != 2 || merged[1].Path != libs[2] {
+		t.Fail()
+	}
+}
+
+func TestParseMountsCase1(t *testing.T) {
+	configs, err := parseMounts("", false)
+	if err != nil || len(configs) != 1 || configs[0] != baseConfig {
+		t.Fail()
+	}
+	configs, err = parseMounts("Base, Dcmi", true)
+	if err != nil || len(configs) != 2 || configs[0] != "base" || configs[1] != "dcmi" {
+		t.Fail()
+	}
+}
+
+func TestParseMountsCase3(t *testing.T) {
+	configs, err := parseMounts("", true)
+	if err != nil || len(configs) != 1 || configs[0] != baseConfig {
+		t.Fail()
+	}
+	stub := gostub.Stub(&emptyMountsMode, emptyMountsNone)
+	defer stub.Reset()
+	configs, err = parseMounts("", true)
+	if err != nil || len(configs) != 0 {
+		t.Fail()
+	}
+	configs, err = parseMounts("", false)
+	if err != nil || len(configs) != 1 || configs[0] != baseConfig {
+		t.Fail()
+	}
+}
+
+func TestParseMountsCase2(t *testing.T) {
+	for _, mounts := range []string{"../../etc/passwd", "base,/etc/passwd", "..", `base\dcmi`, "base,"} {
+		if _, err := parseMounts(mounts, true); err == nil {
+			t.Errorf("mounts %q should be rejected", mounts)
+		}
+	}
+}
+
+func TestParseMountsCase4(t *testing.T) {
+	names := strings.Repeat("a,", maxMountConfigs-1) + "a"
+	if configs, err := parseMounts(names, true); err != nil || len(configs) != maxMountConfigs {
+		t.Errorf("%d configs should be allowed: %v", maxMountConfigs, err)
+	}
+	if _, err := parseMounts(names+",a", true); err == nil {
+		t.Errorf("more than %d configs should be rejected", maxMountConfigs)
+	}
+}
+
+func TestWarnDeprecatedCase1(t *testing.T) {
+	stub := gostub.Stub(&deprecationsWarned, map[string]struct{}{})
+	defer stub.Reset()
+	t.Setenv(ascendHookNoDeprecated, "false")
+	if _, err := parseMounts("Base,dcmi", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseMounts("", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseMounts(strings.Repeat("a", 129), true); err != nil {
+		t.Fatal(err)
+	}
+	for _, behavior := range []string{deprecatedMountsCase, deprecatedImplicitBase, deprecatedLongMounts} {
+		if _, ok := deprecationsWarned[behavior]; !ok {
+			t.Errorf("%s should be warned", behavior)
+		}
+	}
+	// a behavior is warned once per run
+	warnDeprecated(deprecatedMountsCase, "warned again")
+	if len(deprecationsWarned) != 3 {
+		t.Errorf("unexpected warnings %v", deprecationsWarned)
+	}
+}
+
+func TestGetAscendValueCase1(t *testing.T) {
+	env := []string{
+		"ASCEND_VISIBLE_DEVICES=0",
+		"MINDSPORE_ASCEND_VISIBLE_DEVICES=1",
+		"ASCEND_RUNTIME_MOUNTS=base",
+	}
+	if value, err := getAscendValue(env, ascendVisibleDevices); err != nil || value != "0" {
+		t.Fail()
+	}
+	stub := gostub.Stub(&envPrefix, "MINDSPORE_")
+	defer stub.Reset()
+	if value, err := getAscendValue(env, ascendVisibleDevices); err != nil || value != "1" {
+		t.Fail()
+	}
+	if value, err := getAscendValue(env, ascendRuntimeMounts); err != nil || value != "base" {
+		t.Fail()
+	}
+}
+
+func TestGetAscendValueCase2(t *testing.T) {
+	env := []string{
+		"ASCEND_ENV_PREFIX=TF_",
+		"TF_ASCEND_VISIBLE_DEVICES=2",
+		"MINDSPORE_ASCEND_VISIBLE_DEVICES=1",
+	}
+	stub := gostub.Stub(&envPrefix, "MINDSPORE_")
+	defer stub.Reset()
+	if value, err := getAscendValue(env, ascendVisibleDevices); err != nil || value != "2" {
+		t.Fail()
+	}
+	if _, err := getAscendValue([]string{"ASCEND_ENV_PREFIX=../"}, ascendVisibleDevices); err == nil {
+		t.Fail()
+	}
+}
+
+func TestGetContainerConfigCase3(t *testing.T) {
+	file := "state.json"
+	if err := os.WriteFile(file, []byte(`{"ociVersion":"1.0.2","pid":123,"bundle":"/not-exist-bundle"}`), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	defer os.Remove(file)
+	stateFile, err := os.Open(file)
+	if err != nil {
+		t.Fatal("open file failed")
+	}
+	defer stateFile.Close()
+
+	stub := gostub.Stub(&containerConfigInputStream, stateFile)
+	defer stub.Reset()
+
+	_, err = getContainerConfig()
+	if err == nil || !strings.Contains(err.Error(), "/not-exist-bundle/config.json") {
+		t.Fail()
+	}
+}
+
+func TestResolveGroupIDCase1(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(rootfs+"/etc", 0700); err != nil {
+		t.Fatal("create dir failed")
+	}
+	group := "root:x:0:\nHwHiAiUser:x:1000:\n"
+	if err := os.WriteFile(rootfs+"/etc/group", []byte(group), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	if gid, err := resolveGroupID(rootfs, "HwHiAiUser"); err != nil || gid != 1000 {
+		t.Fail()
+	}
+	if gid, err := resolveGroupID(rootfs, "1001"); err != nil || gid != 1001 {
+		t.Fail()
+	}
+	if _, err := resolveGroupID(rootfs, "video"); err == nil {
+		t.Fail()
+	}
+	if _, err := resolveGroupID(rootfs, "-1"); err == nil {
+		t.Fail()
+	}
+	if _, err := resolveGroupID(rootfs, "a:b"); err == nil {
+		t.Fail()
+	}
+}
+
+func TestParseMountEntryCase3(t *testing.T) {
+	entry, err := parseMountEntry("@VIRTUAL /usr/local/Ascend/driver/tools rslave")
+	if err != nil || entry.Condition != "VIRTUAL" || entry.Path != "/usr/local/Ascend/driver/tools" ||
+		entry.Propagation != "rslave" {
+		t.Fail()
+	}
+	if !isConditionMet(entry, []string{"NODRV", "VIRTUAL"}) || isConditionMet(entry, []string{"NODRV"}) {
+		t.Fail()
+	}
+	if !isConditionMet(mountEntry{Path: "/usr/local/dcmi"}, nil) {
+		t.Fail()
+	}
+	if _, err := parseMountEntry("@DEBUG /usr/local/Ascend/driver/tools"); err == nil {
+		t.Fail()
+	}
+	if _, err := parseMountEntry("@VIRTUAL"); err == nil {
+		t.Fail()
+	}
+}
+
+func TestValidateMountConfigCase1(t *testing.T) {
+	file := "validate.list"
+	workDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal("get work dir failed")
+	}
+	content := workDir + " rslave\n\n@VIRTUAL " + workDir + "/main.go\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	defer os.Remove(file)
+	var out bytes.Buffer
+	if err := validateMountConfig(file, &out); err != nil {
+		t.Fatalf("validate failed: %v, %s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "line 1: mount dir") || !strings.Contains(out.String(), "line 3: mount file") {
+		t.Fail()
+	}
+}
+
+func TestValidateMountConfigCase2(t *testing.T) {
+	file := "validate.list"
+	content := "/not-exist-path\n/usr/local/dcmi unbindable\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	defer os.Remove(file)
+	var out bytes.Buffer
+	if err := validateMountConfig(file, &out); err == nil {
+		t.Fail()
+	}
+	if !strings.Contains(out.String(), "line 1: skip") || !strings.Contains(out.String(), "line 2: error") {
+		t.Fail()
+	}
+}
+
+func TestResolveMountEntryCase1(t *testing.T) {
+	dir := t.TempDir()
+	target := dir + "/driver-1.0"
+	if err := os.Mkdir(target, 0700); err != nil {
+		t.Fatal("create dir failed")
+	}
+	link := dir + "/driver"
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal("create link failed")
+	}
+
+	entry, isDir, err := resolveMountEntry(mountEntry{Path: link})
+	if err != nil || !isDir || entry.Path != link {
+		t.Fail()
+	}
+	stub := gostub.Stub(&mountSymlinkMode, symlinkResolve)
+	defer stub.Reset()
+	entry, isDir, err = resolveMountEntry(mountEntry{Path: link})
+	if err != nil || !isDir || entry.Path != target {
+		t.Fail()
+	}
+	stub.Stub(&mountSymlinkMode, symlinkReject)
+	if _, _, err = resolveMountEntry(mountEntry{Path: link}); !errors.Is(err, errSymlinkRejected) {
+		t.Fail()
+	}
+	if _, _, err = resolveMountEntry(mountEntry{Path: target}); err != nil {
+		t.Fail()
+	}
+}
+
+func TestReadContainerStateCase1(t *testing.T) {
+	states := map[string]string{
+		`{"ociVersion":"1.0.2","id":"c1","pid":123,"bundle":"/tmp","sandboxId":"s1","extra":{"a":1}}`: "s1",
+		`{"ociVersion":"1.0.2","id":"c1","pid":123,"bundle":"/tmp",` +
+			`"annotations":{"io.kubernetes.cri.sandbox-id":"s2"}}`: "s2",
+		`{"ociVersion":"1.0.2","id":"c1","pid":123,"bundle":"/tmp"}`: "",
+	}
+	for content, sandboxID := range states {
+		file := "state.json"
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal("create file failed")
+		}
+		stateFile, err := os.Open(file)
+		if err != nil {
+			t.Fatal("open file failed")
+		}
+		stub := gostub.Stub(&containerConfigInputStream, stateFile)
+		state, err := readContainerState()
+		stub.Reset()
+		stateFile.Close()
+		os.Remove(file)
+		if err != nil || state.ID != "c1" || state.Pid != pidSample || getSandboxID(state) != sandboxID {
+			t.Errorf("unexpected state of %s", content)
+		}
+	}
+}
+
+// BenchmarkReadConfigsOfDir reads 4 configs of 128 entries, half of the entries are shared by all configs.
+// checking the config dir once and skipping the shared entries took it
+// from 913us, 323KB, 2525 allocs to 700us, 267KB, 2029 allocs per op
+func BenchmarkReadConfigsOfDir(b *testing.B) {
+	dir, err := os.MkdirTemp(".", "bench")
+	if err != nil {
+		b.Fatal("create dir failed")
+	}
+	defer os.RemoveAll(dir)
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		b.Fatal("get abs dir failed")
+	}
+	const configNumber, sharedNumber = 4, 64
+	configs := make([]string, 0, configNumber)
+	for i := 0; i < configNumber; i++ {
+		var content strings.Builder
+		for j := 0; j < maxEntryNumber; j++ {
+			name := fmt.Sprintf("%s/lib%d_%d.so", absDir, i, j)
+			if j < sharedNumber {
+				name = fmt.Sprintf("%s/lib%d.so", absDir, j)
+			}
+			if err := os.WriteFile(name, nil, 0600); err != nil {
+				b.Fatal("create file failed")
+			}
+			content.WriteString(name + "\n")
+		}
+		config := fmt.Sprintf("config%d", i)
+		if err := os.WriteFile(filepath.Join(dir, config+".list"), []byte(content.String()), 0600); err != nil {
+			b.Fatal("create file failed")
+		}
+		configs = append(configs, config)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := readConfigsOfDir(dir, configs, nil); err != nil {
+			b.Fatalf("read configs failed: %v", err)
+		}
+	}
+}
+
+func TestReadMountConfigCase1(t *testing.T) {
+	dir, err := os.MkdirTemp(".", "configs")
+	if err != nil {
+		t.Fatal("create dir failed")
+	}
+	defer os.RemoveAll(dir)
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		t.Fatal("get abs dir failed")
+	}
+	content := absDir + "\n" + absDir + " rslave\n" + absDir + "/base.list\n"
+	if err := os.WriteFile(filepath.Join(dir, "base.list"), []byte(content), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	seen := map[string]mountEntry{absDir + "/base.list": {Path: absDir + "/base.list"}}
+	fileList, dirList, err := readMountConfig(dir, "base", nil, seen)
+	if err != nil || len(fileList) != 0 || len(dirList) != 1 || dirList[0].Propagation != "" {
+		t.Fail()
+	}
+	// the same path listed again with a different propagation is not dropped silently
+	stub := gostub.Stub(&strictMounts, true)
+	defer stub.Reset()
+	if _, _, err := readMountConfig(dir, "base", nil, map[string]mountEntry{}); err == nil ||
+		!strings.Contains(err.Error(), "different from the first entry") {
+		t.Errorf("the conflicting entries should fail with -strict-mounts, got %v", err)
+	}
+}
+
+func TestLookupAscendValueCase1(t *testing.T) {
+	env := []string{"ASCEND_RUNTIME_MOUNTS="}
+	if value, isSet, err := lookupAscendValue(env, ascendRuntimeMounts); err != nil || !isSet || value != "" {
+		t.Fail()
+	}
+	if _, isSet, err := lookupAscendValue(env, ascendRuntimeOptions); err != nil || isSet {
+		t.Fail()
+	}
+}
+
+func TestHookLoggerCase1(t *testing.T) {
+	logger := &hookLogger{}
+	stub := gostub.Stub(&hookLog, logger)
+	defer stub.Reset()
+	// syslog may be unavailable, then the log is kept in files only
+	initSyslog()
+	hookLog.Debugf("debug %d", 1)
+	hookLog.Infof("info %d", 1)
+	hookLog.Warnf("warn %d", 1)
+	hookLog.Errorf("error %d", 1)
+	if logger.syslogWriter != nil {
+		logger.syslogWriter.Close()
+	}
+}
+
+func TestOpenCheckedFileCase1(t *testing.T) {
+	file := "checked.list"
+	if err := os.WriteFile(file, []byte("/usr/local/dcmi\n"), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	defer os.Remove(file)
+	f, err := openCheckedFile(file)
+	if err != nil {
+		t.Fatalf("open checked file failed: %v", err)
+	}
+	f.Close()
+
+	link := "checked-link.list"
+	if err := os.Symlink(file, link); err != nil {
+		t.Fatal("create link failed")
+	}
+	defer os.Remove(link)
+	if _, err := openCheckedFile(link); err == nil {
+		t.Fail()
+	}
+	if err := os.Chmod(file, 0620); err != nil {
+		t.Fatal("chmod file failed")
+	}
+	if _, err := openCheckedFile(file); err == nil {
+		t.Fail()
+	}
+}
+
+func TestCheckOpenedFileCase1(t *testing.T) {
+	file, swapped := "checked.list", "swapped.list"
+	for _, name := range []string{file, swapped} {
+		if err := os.WriteFile(name, []byte("/usr/local/dcmi\n"), 0600); err != nil {
+			t.Fatal("create file failed")
+		}
+		defer os.Remove(name)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal("open file failed")
+	}
+	defer f.Close()
+	// the opened file is replaced by another one after being opened
+	if err := os.Rename(swapped, file); err != nil {
+		t.Fatal("rename file failed")
+	}
+	if err := checkOpenedFile(f, file); err == nil {
+		t.Fail()
+	}
+}
+
+func TestExpandMountConfigsCase1(t *testing.T) {
+	dir, err := os.MkdirTemp("", "configs")
+	if err != nil {
+		t.Fatal("create dir failed")
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"zeta.list", "base.list", "alpha.list", "readme.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(""), 0600); err != nil {
+			t.Fatal("create config failed")
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub.list"), 0700); err != nil {
+		t.Fatal("create sub dir failed")
+	}
+	configs, err := expandMountConfigs(dir, []string{"zeta", "*"})
+	if err != nil {
+		t.Fatalf("expand configs failed: %v", err)
+	}
+	if strings.Join(configs, ",") != "zeta,alpha,base" {
+		t.Errorf("unexpected configs %v", configs)
+	}
+}
+
+func TestReadMountConfigsCase3(t *testing.T) {
+	dir, err := os.MkdirTemp(".", "configs")
+	if err != nil {
+		t.Fatal("create dir failed")
+	}
+	defer os.RemoveAll(dir)
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		t.Fatal("get abs dir failed")
+	}
+	configs := map[string]string{
+		"base.list":        absDir + "\n",
+		"base.arm64.list":  filepath.Join(absDir, "base.arm64.list") + "\n",
+		"tools.amd64.list": "",
+	}
+	for name, content := range configs {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal("create config failed")
+		}
+	}
+	stub := gostub.Stub(&goArch, "arm64")
+	defer stub.Reset()
+	fileList, dirList, err := readMountConfigs(dir, []string{"base"}, nil)
+	if err != nil || len(fileList) != 1 || len(dirList) != 0 {
+		t.Errorf("the arm64 variant should be used: %v, %v, %v", fileList, dirList, err)
+	}
+	if names, err := expandMountConfigs(dir, []string{allConfigs}); err != nil || strings.Join(names, ",") != "base" {
+		t.Errorf("unexpected configs %v, %v", names, err)
+	}
+	stub.Stub(&goArch, "amd64")
+	fileList, dirList, err = readMountConfigs(dir, []string{"base"}, nil)
+	if err != nil || len(fileList) != 0 || len(dirList) != 1 {
+		t.Errorf("the unqualified config should be used: %v, %v, %v", fileList, dirList, err)
+	}
+	if names, err := expandMountConfigs(dir, []string{allConfigs}); err != nil ||
+		strings.Join(names, ",") != "base,tools" {
+		t.Errorf("unexpected configs %v, %v", names, err)
+	}
+}
+
+func TestIsHookDisabledCase1(t *testing.T) {
+	dir := t.TempDir()
+	stub := gostub.Stub(&mountConfigDir, dir)
+	defer stub.Reset()
+	if isHookDisabled([]string{"ASCEND_HOOK_DISABLE=false"}) || isHookDisabled([]string{"ASCEND_HOOK_DISABLE=yes"}) {
+		t.Fail()
+	}
+	if !isHookDisabled([]string{"ASCEND_HOOK_DISABLE=true", "ASCEND_VISIBLE_DEVICES=0"}) {
+		t.Fail()
+	}
+	if err := os.WriteFile(filepath.Join(dir, hookDisabledFile), nil, 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	cfg, err := resolveHookConfig(&containerConfig{Pid: pidSample, Env: []string{"ASCEND_VISIBLE_DEVICES=0"}})
+	if err != nil || cfg.Enabled {
+		t.Fail()
+	}
+}
+
+func TestGetDriverPathCase1(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ascend_install.info")
+	if err := os.WriteFile(file, []byte("Driver_Install_Path_Param=/usr/local/Ascend\n"), 0666); err != nil {
+		t.Fatal("create file failed")
+	}
+	if err := os.Chmod(file, 0666); err != nil {
+		t.Fatal("chmod file failed")
+	}
+	stub := gostub.Stub(&ascendInstallInfoPath, file)
+	defer stub.Reset()
+	_, err := getDriverPath()
+	if err == nil || !strings.Contains(err.Error(), "check driver install info "+file) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestParseDeviceManagersCase1(t *testing.T) {
+	names, err := parseDeviceManagers(" davinci_manager, hisi_hdc ")
+	if err != nil || strings.Join(names, ",") != "davinci_manager,hisi_hdc" {
+		t.Fail()
+	}
+	if names, err := parseDeviceManagers(""); err != nil || len(names) != 0 {
+		t.Fail()
+	}
+	for _, managers := range []string{"davinci_manager,", "../sda", "hisi_hdc,dev/mm"} {
+		if _, err := parseDeviceManagers(managers); err == nil {
+			t.Errorf("%q should be invalid", managers)
+		}
+	}
+}
+
+func TestCheckDeviceManagersCase1(t *testing.T) {
+	stub := gostub.Stub(&deviceManagerNames, []string{"null"})
+	defer stub.Reset()
+	stub.Stub(&hostDevPath, "/dev")
+	if err := checkDeviceManagers(); err != nil {
+		t.Errorf("char device should pass: %v", err)
+	}
+	devDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(devDir, "null"), nil, 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	stub.Stub(&hostDevPath, devDir)
+	if err := checkDeviceManagers(); err == nil {
+		t.Fail()
+	}
+	stub.Stub(&deviceManagerNames, []string{"devmm_svm"})
+	if err := checkDeviceManagers(); err == nil {
+		t.Fail()
+	}
+}
+
+func TestCheckDeviceNodeCase1(t *testing.T) {
+	if err := checkDeviceNode("/dev/null"); err != nil {
+		t.Errorf("char device should pass: %v", err)
+	}
+	// a regular file at the device path means a broken driver install
+	fake := filepath.Join(t.TempDir(), "davinci0")
+	if err := os.WriteFile(fake, nil, 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	if err := checkDeviceNode(fake); err == nil || !strings.Contains(err.Error(), "not a char device") {
+		t.Errorf("regular file should fail: %v", err)
+	}
+	if err := checkDeviceNode(filepath.Join(t.TempDir(), "davinci1")); err == nil {
+		t.Error("missing device should fail")
+	}
+	// the major of /dev/null is 1
+	stub := gostub.Stub(&deviceMajors, map[int64]struct{}{236: {}})
+	defer stub.Reset()
+	if err := checkDeviceNode("/dev/null"); err == nil || !strings.Contains(err.Error(), "major 1") {
+		t.Errorf("device of other major should fail: %v", err)
+	}
+}
+
+func TestReplayHookCase1(t *testing.T) {
+	conCfg := &containerConfig{Pid: pidSample, Rootfs: ".", Env: []string{}}
+	stub := gostub.StubFunc(&getContainerConfig, conCfg, nil)
+	defer stub.Reset()
+	var out bytes.Buffer
+	if err := replayHook(&out); err != nil || !strings.Contains(out.String(), "nothing to do") {
+		t.Errorf("unexpected replay %v, %s", err, out.String())
+	}
+
+	conCfg.Env = []string{"ASCEND_VISIBLE_DEVICES=0"}
+	stub.Stub(&mountConfigDir, "not-exist-config-dir")
+	out.Reset()
+	if err := replayHook(&out); err == nil || !strings.Contains(out.String(), "== hook config\nerror: ") {
+		t.Errorf("unexpected replay %v, %s", err, out.String())
+	}
+}
+
+func TestAcquireNodeLockCase1(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hook.lock")
+	unlock, err := acquireNodeLock(file)
+	if err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	stub := gostub.Stub(&lockTimeout, 300*time.Millisecond)
+	defer stub.Reset()
+	start := time.Now()
+	if _, err := acquireNodeLock(file); err == nil || time.Since(start) < lockTimeout {
+		t.Errorf("the held lock should time out: %v", err)
+	}
+	unlock()
+	unlock, err = acquireNodeLock(file)
+	if err != nil {
+		t.Fatalf("the released lock should be acquired: %v", err)
+	}
+	unlock()
+	if _, err := acquireNodeLock(filepath.Join(t.TempDir(), "not-exist-dir", "hook.lock")); err == nil {
+		t.Fail()
+	}
+}
+
+func TestHookTracerCase1(t *testing.T) {
+	var disabled *hookTracer
+	disabled.startSpan("state decode")(nil)
+	disabled.finish("not-exist-dir/trace", nil)
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	tracer := newHookTracer("00-" + traceID + "-" + parentID + "-01")
+	tracer.startSpan("state decode")(nil)
+	tracer.startSpan("mount")(errors.New("mount failed"))
+	file := filepath.Join(t.TempDir(), "trace.json")
+	tracer.finish(file, nil)
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal("read trace failed")
+	}
+	var trace struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Status       struct {
+						Code int `json:"code"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(content, &trace); err != nil || len(trace.ResourceSpans) != 1 {
+		t.Fatalf("unexpected trace %s, %v", content, err)
+	}
+	spans := trace.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 3 || spans[0].TraceID != traceID || spans[0].ParentSpanID != parentID ||
+		spans[1].ParentSpanID != spans[0].SpanID || spans[2].Name != "mount" || spans[2].Status.Code != 2 {
+		t.Errorf("unexpected spans %s", content)
+	}
+
+	for _, invalid := range []string{"", "00-" + traceID + "-0000000000000000-01", "00-xyz-" + parentID + "-01"} {
+		if tracer := newHookTracer(invalid); tracer.traceID == traceID || len(tracer.traceID) != len(traceID) {
+			t.Errorf("a new trace should be started for %q", invalid)
+		}
+	}
+}
+
+func TestWriteMountRecordCase1(t *testing.T) {
+	rootfs := t.TempDir()
+	cfg := &hookConfig{
+		FileMounts: []mountEntry{{Path: "/usr/local/bin/npu-smi"}},
+		DirMounts:  []mountEntry{{Path: "/usr/local/Ascend/driver", Propagation: "rslave"}},
+	}
+	if err := writeMountRecord(rootfs, cfg); err != nil {
+		t.Fatalf("write mount record failed: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(rootfs, mountRecordFile))
+	if err != nil || !strings.Contains(string(content), `"path": "/usr/local/Ascend/driver"`) {
+		t.Errorf("unexpected mount record %s, %v", content, err)
+	}
+
+	// a symlink left by the container must not be followed out of the rootfs
+	outside := filepath.Join(t.TempDir(), "outside")
+	if err := os.Remove(filepath.Join(rootfs, mountRecordFile)); err != nil {
+		t.Fatal("remove record failed")
+	}
+	if err := os.Symlink(outside, filepath.Join(rootfs, mountRecordFile)); err != nil {
+		t.Fatal("create link failed")
+	}
+	_ = writeMountRecord(rootfs, cfg)
+	if _, err := os.Stat(outside); err == nil {
+		t.Fail()
+	}
+}
+
+func TestWriteMountRecordCase2(t *testing.T) {
+	rootfs := t.TempDir()
+	cfg := &hookConfig{FileMounts: []mountEntry{{Path: "/usr/local/bin/npu-smi"}}}
+	for _, mode := range []os.FileMode{defaultOutputMode, 0640} {
+		stub := gostub.Stub(&outputFileMode, mode)
+		if err := writeMountRecord(rootfs, cfg); err != nil {
+			t.Fatalf("write mount record failed: %v", err)
+		}
+		stub.Reset()
+		info, err := os.Stat(filepath.Join(rootfs, mountRecordFile))
+		if err != nil || info.Mode().Perm() != mode {
+			t.Errorf("mount record should be created with mode %o: %v, %v", mode, info.Mode(), err)
+		}
+	}
+	// no temp file is left beside the record
+	if files, err := os.ReadDir(filepath.Dir(filepath.Join(rootfs, mountRecordFile))); err != nil || len(files) != 1 {
+		t.Errorf("unexpected files %v, %v", files, err)
+	}
+
+	if mode, err := parseOutputMode("0640"); err != nil || mode != 0640 {
+		t.Errorf("unexpected mode %o, %v", mode, err)
+	}
+	for _, invalid := range []string{"0666", "0700", "0755", "rw", "01600"} {
+		if _, err := parseOutputMode(invalid); err == nil {
+			t.Errorf("%s should be invalid", invalid)
+		}
+	}
+}
+
+func TestWriteSetupReportCase1(t *testing.T) {
+	devDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(devDir, "davinci0"), nil, 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	stub := gostub.Stub(&hostDevPath, devDir)
+	defer stub.Reset()
+	stub.Stub(&deviceManagerNames, []string{})
+	rootfs := t.TempDir()
+	cfg := &hookConfig{
+		ContainerID:  "c1",
+		MountConfigs: []string{"base"},
+		FileMounts:   []mountEntry{{Path: "/usr/local/bin/npu-smi"}, {Path: "/etc/ascend_install.info", Copy: true}},
+		DirMounts:    []mountEntry{{Path: "/usr/local/Ascend/driver"}},
+	}
+	writeSetupReport(rootfs, cfg)
+	content, err := os.ReadFile(filepath.Join(rootfs, setupReportFile))
+	if err != nil {
+		t.Fatalf("read setup report failed: %v", err)
+	}
+	for _, line := range []string{"exposed 1 devices: " + devDir + "/davinci0\n",
+		"mounted 1 files, 1 dirs, copied 1 files from configs base\n", "  /usr/local/Ascend/driver\n"} {
+		if !strings.Contains(string(content), line) {
+			t.Errorf("%q is not in the setup report %s", line, content)
+		}
+	}
+	// a failure is only logged
+	broken := t.TempDir()
+	if err := os.WriteFile(filepath.Join(broken, "var"), nil, 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	writeSetupReport(broken, cfg)
+}
+
+func TestResolveConfigDirCase1(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "configs")
+	if err := os.Mkdir(dir, 0750); err != nil {
+		t.Fatal("create dir failed")
+	}
+	if resolved, err := resolveConfigDir(dir); err != nil || resolved != dir {
+		t.Errorf("unexpected dir %s, %v", resolved, err)
+	}
+	link := filepath.Join(base, "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal("create link failed")
+	}
+	if resolved, err := resolveConfigDir(link); err != nil || resolved != dir {
+		t.Errorf("unexpected dir %s, %v", resolved, err)
+	}
+	stub := gostub.Stub(&rejectConfigDirLink, true)
+	if _, err := resolveConfigDir(link); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Fail()
+	}
+	stub.Reset()
+}
+
+func TestResolveConfigDirCase2(t *testing.T) {
+	base := t.TempDir()
+	dangling := filepath.Join(base, "dangling")
+	if err := os.Symlink(filepath.Join(base, "not-exist"), dangling); err != nil {
+		t.Fatal("create link failed")
+	}
+	if _, err := resolveConfigDir(dangling); err == nil || !strings.Contains(err.Error(), "dangling") {
+		t.Fail()
+	}
+	file := filepath.Join(base, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	toFile := filepath.Join(base, "to-file")
+	if err := os.Symlink(file, toFile); err != nil {
+		t.Fatal("create link failed")
+	}
+	if _, err := resolveConfigDir(toFile); err == nil || !strings.Contains(err.Error(), "not a dir") {
+		t.Fail()
+	}
+	if _, err := resolveConfigDir(file); err == nil {
+		t.Fail()
+	}
+}
+
+func TestWaitConfigDirCase1(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "configs")
+	// no wait by default
+	start := time.Now()
+	waitConfigDir(dir)
+	if time.Since(start) > configDirWaitPeriod {
+		t.Error("should not wait by default")
+	}
+
+	stub := gostub.Stub(&configDirWait, 500*time.Millisecond)
+	defer stub.Reset()
+	start = time.Now()
+	waitConfigDir(dir)
+	if elapsed := time.Since(start); elapsed < configDirWait || elapsed > 2*configDirWait {
+		t.Errorf("unexpected wait %v", elapsed)
+	}
+
+	stub.Stub(&configDirWait, 5*time.Second)
+	go func() {
+		time.Sleep(configDirWaitPeriod)
+		os.Mkdir(dir, 0750)
+	}()
+	start = time.Now()
+	waitConfigDir(dir)
+	if _, err := os.Stat(dir); err != nil || time.Since(start) > time.Second {
+		t.Errorf("should return once the dir appears, waited %v", time.Since(start))
+	}
+}
+
+func TestNotifySetupCase1(t *testing.T) {
+	devDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(devDir, "davinci0"), nil, 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	notifyFile := filepath.Join(t.TempDir(), "notify")
+	stub := gostub.Stub(&hostDevPath, devDir)
+	defer stub.Reset()
+	stub.Stub(&notifyPath, notifyFile)
+	notifySetup(&containerConfig{ID: "c1", SandboxID: "s1"})
+	notifySetup(&containerConfig{ID: "c2"})
+	content, err := os.ReadFile(notifyFile)
+	if err != nil {
+		t.Fatal("read notification failed")
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || lines[0] != `{"containerId":"c1","sandboxId":"s1","devices":["`+devDir+`/davinci0"]}` {
+		t.Errorf("unexpected notification %s", content)
+	}
+
+	// a pipe without reader and a missing dir should only be logged
+	fifo := filepath.Join(t.TempDir(), "fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal("create fifo failed")
+	}
+	stub.Stub(&notifyPath, fifo)
+	notifySetup(&containerConfig{ID: "c3"})
+	stub.Stub(&notifyPath, "/not-exist-dir/notify")
+	notifySetup(&containerConfig{ID: "c4"})
+}
+
+func TestHasAscendDeviceRuleCase1(t *testing.T) {
+	devDir := t.TempDir()
+	// /dev/null stands for a davinci device, its major is 1
+	if err := os.Symlink("/dev/null", filepath.Join(devDir, "davinci0")); err != nil {
+		t.Fatal("create link failed")
+	}
+	stub := gostub.Stub(&hostDevPath, devDir)
+	defer stub.Reset()
+	major, otherMajor := int64(1), int64(10)
+	if !hasAscendDeviceRule([]specs.LinuxDeviceCgroup{{Allow: false, Type: "a"}, {Allow: true, Type: "c", Major: &major}}) {
+		t.Fail()
+	}
+	if hasAscendDeviceRule([]specs.LinuxDeviceCgroup{{Allow: true, Type: "c", Major: &otherMajor},
+		{Allow: true, Type: "b", Major: &major}, {Allow: false, Type: "c", Major: &major}}) {
+		t.Fail()
+	}
+	if hasAscendDeviceRule(nil) {
+		t.Fail()
+	}
+}
+
+func TestCheckEmptySetupCase1(t *testing.T) {
+	devDir := t.TempDir()
+	stub := gostub.Stub(&hostDevPath, devDir)
+	defer stub.Reset()
+	cfg := &hookConfig{ContainerID: "c1", FileMounts: []mountEntry{}, DirMounts: []mountEntry{}}
+
+	stub.Stub(&emptySetupMode, emptySetupProceed)
+	if skip, err := checkEmptySetup(cfg); skip || err != nil {
+		t.Fail()
+	}
+	stub.Stub(&emptySetupMode, emptySetupSkip)
+	if skip, err := checkEmptySetup(cfg); !skip || err != nil {
+		t.Fail()
+	}
+	stub.Stub(&emptySetupMode, emptySetupError)
+	if _, err := checkEmptySetup(cfg); err == nil {
+		t.Fail()
+	}
+
+	// any mount or davinci device means there is something to set up
+	if err := os.WriteFile(filepath.Join(devDir, "davinci_manager"), nil, 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	if _, err := checkEmptySetup(cfg); err == nil {
+		t.Fail()
+	}
+	cfg.DirMounts = []mountEntry{{Path: "/usr/local/Ascend/driver"}}
+	if skip, err := checkEmptySetup(cfg); skip || err != nil {
+		t.Fail()
+	}
+	cfg.DirMounts = []mountEntry{}
+	if err := os.WriteFile(filepath.Join(devDir, "davinci0"), nil, 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	if skip, err := checkEmptySetup(cfg); skip || err != nil {
+		t.Fail()
+	}
+}
+
+func TestParseEnvAllowlistCase1(t *testing.T) {
+	names, err := parseEnvAllowlist("")
+	if err != nil || len(names) != len(containerEnvNames) {
+		t.Fail()
+	}
+	if _, err := parseEnvAllowlist("ASCEND_VISIBLE_DEVICES,LD_PRELOAD"); err == nil {
+		t.Fail()
+	}
+	names, err = parseEnvAllowlist(" ASCEND_VISIBLE_DEVICES ")
+	if err != nil {
+		t.Fatalf("parse allowlist failed: %v", err)
+	}
+	stub := gostub.Stub(&allowedEnvNames, names)
+	defer stub.Reset()
+	env := []string{"ASCEND_VISIBLE_DEVICES=0", "ASCEND_RUNTIME_MOUNTS=base", "ASCEND_HOOK_DISABLE=true"}
+	if value, _ := getAscendValue(env, ascendVisibleDevices); value != "0" {
+		t.Fail()
+	}
+	if _, isSet, _ := lookupAscendValue(env, ascendRuntimeMounts); isSet {
+		t.Fail()
+	}
+	if isHookDisabled(env) {
+		t.Fail()
+	}
+}
+
+func TestApplyMountExclusionsCase1(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a/b", "a/d", "e"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0750); err != nil {
+			t.Fatal("create dir failed")
+		}
+	}
+	for _, file := range []string{"a/c.txt", "f.txt"} {
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0600); err != nil {
+			t.Fatal("create file failed")
+		}
+	}
+	dirMounts := []mountEntry{
+		{Path: root, Propagation: "rslave"},
+		{Path: root + "/a/b", Exclude: true},
+		{Path: root + "/a/d", Exclude: true},
+		{Path: "/not-mounted", Exclude: true},
+	}
+	files, dirs, err := applyMountExclusions([]mountEntry{}, dirMounts)
+	if err != nil {
+		t.Fatalf("apply exclusions failed: %v", err)
+	}
+	paths := func(entries []mountEntry) string {
+		list := make([]string, 0)
+		for _, entry := range entries {
+			list = append(list, strings.TrimPrefix(entry.Path, root)+" "+entry.Propagation)
+		}
+		return strings.Join(list, ",")
+	}
+	if paths(files) != "/f.txt rslave,/a/c.txt rslave" || paths(dirs) != "/e rslave" {
+		t.Errorf("unexpected mounts %s; %s", paths(files), paths(dirs))
+	}
+}
+
+// TestApplyMountExclusionsCase2 tests an exclusion is taken out of every dir mount containing it, e.g.
+// /usr/local/Ascend, /usr/local/Ascend/driver and !/usr/local/Ascend/driver/tmp
+func TestApplyMountExclusionsCase2(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"driver/tmp", "driver/lib64", "firmware"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0750); err != nil {
+			t.Fatal("create dir failed")
+		}
+	}
+	dirMounts := []mountEntry{
+		{Path: root},
+		{Path: root + "/driver", Propagation: "rslave"},
+		{Path: root + "/driver/tmp", Exclude: true},
+	}
+	files, dirs, err := applyMountExclusions([]mountEntry{}, dirMounts)
+	if err != nil {
+		t.Fatalf("apply exclusions failed: %v", err)
+	}
+	list := make([]string, 0)
+	for _, entry := range dirs {
+		list = append(list, strings.TrimPrefix(entry.Path, root)+" "+entry.Propagation)
+	}
+	if len(files) != 0 || strings.Join(list, ",") != "/firmware ,/driver/lib64 rslave" {
+		t.Errorf("unexpected mounts %v; %s", files, list)
+	}
+}
+
+// TestNestedMountOnPathCase1 tests only the dir mounts between parent and exclude are taken, not the exclusions
+func TestNestedMountOnPathCase1(t *testing.T) {
+	dirMounts := []mountEntry{
+		{Path: "/usr/local/Ascend"},
+		{Path: "/usr/local/Ascend/driver", Exclude: true},
+		{Path: "/usr/local/Ascend/driver/lib64"},
+		{Path: "/usr/local/Ascend/firmware"},
+	}
+	exclude := "/usr/local/Ascend/driver/lib64/tmp"
+	if nested := nestedMountOnPath(dirMounts, "/usr/local/Ascend", exclude); nested != "/usr/local/Ascend/driver/lib64" {
+		t.Errorf("the nested dir mount should be taken, got %s", nested)
+	}
+	if nested := nestedMountOnPath(dirMounts[:2], "/usr/local/Ascend", exclude); nested != exclude {
+		t.Errorf("exclude itself should be returned without a nested dir mount, got %s", nested)
+	}
+}
+
+func TestParseMountEntryCase4(t *testing.T) {
+	entry, err := parseMountEntry("@VIRTUAL !/usr/local/Ascend/tmp/")
+	if err != nil || !entry.Exclude || entry.Path != "/usr/local/Ascend/tmp" || entry.Condition != "VIRTUAL" {
+		t.Errorf("unexpected entry %+v, %v", entry, err)
+	}
+	for _, line := range []string{"!tmp", "!/usr/local/Ascend/tmp rslave"} {
+		if _, err := parseMountEntry(line); err == nil {
+			t.Errorf("%q should be invalid", line)
+		}
+	}
+}
+
+func TestPlanMountsCase1(t *testing.T) {
+	source := t.TempDir()
+	file := filepath.Join(source, "npu-smi")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	rootfs := t.TempDir()
+	cfg := &hookConfig{
+		FileMounts: []mountEntry{{Path: file}},
+		DirMounts:  []mountEntry{{Path: source, Propagation: "rslave"}},
+	}
+	mounts, err := planMounts(rootfs, cfg)
+	if err != nil {
+		t.Fatalf("plan mounts failed: %v", err)
+	}
+	expected := []mountAction{
+		{Source: file, Dest: filepath.Join(rootfs, file)},
+		{Source: source, Dest: filepath.Join(rootfs, source), Propagation: "rslave", IsDir: true},
+	}
+	if fmt.Sprint(mounts) != fmt.Sprint(expected) {
+		t.Errorf("unexpected mounts %+v", mounts)
+	}
+
+	cfg.DirMounts = append(cfg.DirMounts, mountEntry{Path: "/not-exist-dir"})
+	if _, err := planMounts(rootfs, cfg); err == nil || !strings.Contains(err.Error(), "mount dir /not-exist-dir") {
+		t.Fail()
+	}
+}
+
+func TestCopyFileCase1(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "ascend_install.info")
+	if err := os.WriteFile(source, []byte("Driver_Install_Path_Param=/usr/local/Ascend\n"), 0640); err != nil {
+		t.Fatal("create file failed")
+	}
+	entry, err := parseMountEntry(source + " copy")
+	if err != nil || !entry.Copy {
+		t.Fatalf("unexpected entry %+v, %v", entry, err)
+	}
+	if _, err := parseMountEntry(source + " rslave copy"); err == nil {
+		t.Error("copy with a propagation should be invalid")
+	}
+	if err := checkCopyEntry(entry, false); err != nil {
+		t.Errorf("small file should be copied: %v", err)
+	}
+	if err := checkCopyEntry(mountEntry{Path: filepath.Dir(source), Copy: true}, true); err == nil {
+		t.Error("dir should not be copied")
+	}
+
+	dest := filepath.Join(t.TempDir(), "etc", "ascend_install.info")
+	if err := copyFile(dest, source); err != nil {
+		t.Fatalf("copy file failed: %v", err)
+	}
+	content, err := os.ReadFile(dest)
+	if err != nil || string(content) != "Driver_Install_Path_Param=/usr/local/Ascend\n" {
+		t.Errorf("unexpected content %q, %v", content, err)
+	}
+
+	large := filepath.Join(t.TempDir(), "large")
+	if err := os.WriteFile(large, make([]byte, maxCopySize+1), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	if err := checkCopyEntry(mountEntry{Path: large, Copy: true}, false); err == nil {
+		t.Error("large file should not be copied")
+	}
+	if err := copyFile(dest, large); err == nil {
+		t.Error("large file should not be copied")
+	}
+}
+
+func TestCheckRootfsWritableCase1(t *testing.T) {
+	if err := checkRootfsWritable(t.TempDir()); err != nil {
+		t.Errorf("temp dir should be writable: %v", err)
+	}
+	if err := checkRootfsWritable("not-exist-rootfs"); err == nil {
+		t.Fail()
+	}
+	source := filepath.Join(t.TempDir(), "ascend_install.info")
+	if err := os.WriteFile(source, nil, 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	cfg := &hookConfig{FileMounts: []mountEntry{{Path: source, Copy: true}}}
+	if err := mountAll("not-exist-rootfs", cfg); err == nil || !strings.Contains(err.Error(), "rootfs") {
+		t.Errorf("copy into a missing rootfs should fail early: %v", err)
+	}
+}
+
+func TestReadMountConfigCase2(t *testing.T) {
+	dir, err := os.MkdirTemp(".", "configs")
+	if err != nil {
+		t.Fatal("create dir failed")
+	}
+	defer os.RemoveAll(dir)
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		t.Fatal("get abs dir failed")
+	}
+	if err := os.Mkdir(filepath.Join(absDir, "driver-1.0"), 0750); err != nil {
+		t.Fatal("create dir failed")
+	}
+	if err := os.Symlink(filepath.Join(absDir, "driver-1.0"), filepath.Join(absDir, "driver")); err != nil {
+		t.Fatal("create link failed")
+	}
+	// the link and its target are the same destination once the link is resolved
+	content := absDir + "/driver-1.0\n" + absDir + "/driver\n"
+	if err := os.WriteFile(filepath.Join(dir, "base.list"), []byte(content), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	stub := gostub.Stub(&mountSymlinkMode, symlinkResolve)
+	defer stub.Reset()
+	_, dirList, err := readMountConfig(dir, "base", nil, map[string]mountEntry{})
+	if err != nil || len(dirList) != 1 {
+		t.Errorf("unexpected mounts %+v, %v", dirList, err)
+	}
+	stub.Stub(&strictMounts, true)
+	if _, _, err := readMountConfig(dir, "base", nil, map[string]mountEntry{}); err == nil {
+		t.Fail()
+	}
+}
+
+func TestReadDevDirCase1(t *testing.T) {
+	devDir := t.TempDir()
+	for _, name := range []string{"davinci1", "davinci0", "hisi_hdc"} {
+		if err := os.WriteFile(filepath.Join(devDir, name), nil, 0600); err != nil {
+			t.Fatal("create file failed")
+		}
+	}
+	names, err := readDevDir(devDir)
+	if err != nil || strings.Join(names, ",") != "davinci0,davinci1,hisi_hdc" {
+		t.Errorf("unexpected names %v, %v", names, err)
+	}
+	stub := gostub.Stub(&devScanMaxEntries, 2)
+	defer stub.Reset()
+	if _, err := readDevDir(devDir); err == nil || !strings.Contains(err.Error(), "more than 2 entries") {
+		t.Fail()
+	}
+	stub.Stub(&devScanTimeout, time.Duration(0))
+	if _, err := readDevDir(devDir); err == nil {
+		t.Fail()
+	}
+	if _, err := readDevDir(filepath.Join(devDir, "not-exist")); err == nil {
+		t.Fail()
+	}
+}
+
+func TestParseMountEntryCase5(t *testing.T) {
+	entry, err := parseMountEntry("@VIRTUAL ?module:drv_davinci_intf /usr/local/Ascend/driver/tools rslave")
+	if err != nil || entry.Probe != "module:drv_davinci_intf" || entry.Condition != "VIRTUAL" ||
+		entry.Path != "/usr/local/Ascend/driver/tools" || entry.Propagation != "rslave" {
+		t.Errorf("unexpected entry %+v, %v", entry, err)
+	}
+	for _, line := range []string{"?module: /usr/local", "?exists:dev /usr/local", "?run:reboot /usr/local",
+		"?exists /usr/local", "?module:a/b /usr/local", "?exists:/dev/../etc /usr/local"} {
+		if _, err := parseMountEntry(line); err == nil {
+			t.Errorf("%q should be invalid", line)
+		}
+	}
+}
+
+func TestIsProbeMetCase1(t *testing.T) {
+	modules := t.TempDir()
+	if err := os.Mkdir(filepath.Join(modules, "drv_davinci_intf"), 0750); err != nil {
+		t.Fatal("create dir failed")
+	}
+	stub := gostub.Stub(&sysModulePath, modules)
+	defer stub.Reset()
+	for probe, expected := range map[string]bool{
+		"":                        true,
+		"module:drv_davinci_intf": true,
+		"module:drv_pcie":         false,
+		"exists:" + modules:       true,
+		"exists:/not-exist-path":  false,
+	} {
+		if isProbeMet(mountEntry{Path: "/usr/local", Probe: probe}) != expected {
+			t.Errorf("probe %q should be %t", probe, expected)
+		}
+	}
+}
+
+func TestParseFlagsCase1(t *testing.T) {
+	stub := gostub.Stub(&dumpMode, false)
+	defer stub.Reset()
+	stub.Stub(&stateFilePath, "")
+	var usage bytes.Buffer
+	stub.Stub(&flagOutput, &usage)
+	if err := parseFlags([]string{"-dump"}); err != nil || !dumpMode {
+		t.Errorf("parse flags failed: %v", err)
+	}
+	if err := parseFlags([]string{"-h"}); !errors.Is(err, flag.ErrHelp) || !strings.Contains(usage.String(), "-dump") {
+		t.Errorf("unexpected error %v", err)
+	}
+	// kata-agent passes the hook type
+	if err := parseFlags([]string{"-dump", "prestart"}); err != nil {
+		t.Errorf("the hook type should be accepted: %v", err)
+	}
+	for _, args := range [][]string{{"poststart"}, {"prestart", "extra"}, {"-dump", "extra"}, {"-version"},
+		{"-empty-setup", "never"}} {
+		err := parseFlags(args)
+		if err == nil || !strings.Contains(err.Error(), "-h") && !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("%v should be rejected, got %v", args, err)
+		}
+	}
+}
+
+func TestParseDeviceMajorsCase1(t *testing.T) {
+	majors, err := parseDeviceMajors(" 236, 237")
+	if _, ok := majors[237]; err != nil || len(majors) != 2 || !ok {
+		t.Errorf("unexpected majors %v, %v", majors, err)
+	}
+	for _, invalid := range []string{"1", "4096", "236,", "davinci"} {
+		if _, err := parseDeviceMajors(invalid); err == nil {
+			t.Errorf("%q should be invalid", invalid)
+		}
+	}
+	// the configured majors are used instead of the detected ones
+	stub := gostub.Stub(&deviceMajors, majors)
+	defer stub.Reset()
+	stub.Stub(&hostDevPath, t.TempDir())
+	major := int64(236)
+	if !hasAscendDeviceRule([]specs.LinuxDeviceCgroup{{Allow: true, Type: "c", Major: &major}}) {
+		t.Fail()
+	}
+}
+
+func TestGetSkipReasonCase1(t *testing.T) {
+	_, _, notFound := resolveMountEntry(mountEntry{Path: "/not-exist-path"})
+	_, _, wrongType := resolveMountEntry(mountEntry{Path: "/dev/null"})
+	for err, expected := range map[error]string{
+		notFound:                 skipNotFound,
+		wrongType:                skipWrongType,
+		os.ErrPermission:         skipPermission,
+		errors.New("other fail"): skipOtherError,
+	} {
+		if reason := getSkipReason(err); reason != expected {
+			t.Errorf("reason of %v should be %s, got %s", err, expected, reason)
+		}
+	}
+}
+
+func TestLoadHookDefaultsCase1(t *testing.T) {
+	if defaults, err := loadHookDefaults("not-exist-hook.conf"); err != nil || len(defaults) != 0 {
+		t.Fail()
+	}
+	file := "hook.conf"
+	content := "# node policy\nlog-level = debug\n\nstrict-mounts=true\nempty-setup = error\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	defer os.Remove(file)
+	defaults, err := loadHookDefaults(file)
+	if err != nil || len(defaults) != 3 || defaults["empty-setup"] != "error" {
+		t.Fatalf("unexpected defaults %v, %v", defaults, err)
+	}
+
+	stub := gostub.Stub(&hookDefaults, defaults)
+	defer stub.Reset()
+	stub.Stub(&strictMounts, false)
+	stub.Stub(&emptySetupMode, emptySetupProceed)
+	stub.Stub(&flagOutput, io.Discard)
+	// the arguments take precedence over the defaults
+	if err := parseFlags([]string{"-empty-setup", "skip"}); err != nil || !strictMounts || emptySetupMode != "skip" {
+		t.Errorf("unexpected flags %v, %v, %v", strictMounts, emptySetupMode, err)
+	}
+	stub.Stub(&hookDefaults, map[string]string{"dump": "true"})
+	if err := parseFlags(nil); err == nil {
+		t.Fail()
+	}
+
+	for _, invalid := range []string{"log-level=verbose\n", "strict-mounts\n"} {
+		if err := os.WriteFile(file, []byte(invalid), 0600); err != nil {
+			t.Fatal("create file failed")
+		}
+		if _, err := loadHookDefaults(file); err == nil {
+			t.Errorf("%q should be invalid", invalid)
+		}
+	}
+	// the error tells which kind of config failed the check
+	if err := os.Chmod(file, 0620); err != nil {
+		t.Fatal("chmod file failed")
+	}
+	if _, err := loadHookDefaults(file); err == nil || !strings.Contains(err.Error(), "check hook config") {
+		t.Errorf("the error should tell the hook config, got %v", err)
+	}
+}
+
+func TestCheckEnvConflictsCase1(t *testing.T) {
+	stub := gostub.Stub(&envAliases, map[string][]string{ascendVisibleDevices: {"ASCEND_DEVICES"}})
+	defer stub.Reset()
+	conflict := []string{"ASCEND_VISIBLE_DEVICES=0", "ASCEND_DEVICES=1"}
+	for _, env := range [][]string{conflict, {"ASCEND_VISIBLE_DEVICES=0", "ASCEND_DEVICES=0"}, {"ASCEND_DEVICES=1"}} {
+		if err := checkEnvConflicts(env); err != nil {
+			t.Errorf("%v should pass: %v", env, err)
+		}
+	}
+	stub.Stub(&strictEnv, true)
+	if err := checkEnvConflicts(conflict); err == nil || !strings.Contains(err.Error(), `ASCEND_DEVICES="1"`) {
+		t.Errorf("conflict should fail in strict mode: %v", err)
+	}
+	conCfg := containerConfig{Pid: pidSample, Rootfs: ".", Env: conflict}
+	if _, err := resolveHookConfig(&conCfg); err == nil {
+		t.Fail()
+	}
+	// the variables not allowed are never read, so they can not conflict
+	stub.Stub(&allowedEnvNames, makeEnvNameSet([]string{ascendRuntimeMounts}))
+	if err := checkEnvConflicts(conflict); err != nil {
+		t.Errorf("not allowed variable should be ignored: %v", err)
+	}
+}
+
+func TestLoadEnvAliasesCase1(t *testing.T) {
+	if aliases, err := loadEnvAliases("not-exist-aliases.conf"); err != nil || len(aliases) != 0 {
+		t.Fail()
+	}
+	file := "env-aliases.conf"
+	content := "# old names\nASCEND_DEVICES ASCEND_VISIBLE_DEVICES\nNPU_DEVICES ASCEND_VISIBLE_DEVICES\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	defer os.Remove(file)
+	aliases, err := loadEnvAliases(file)
+	if err != nil || len(aliases[ascendVisibleDevices]) != 2 {
+		t.Fatalf("unexpected aliases %v, %v", aliases, err)
+	}
+
+	stub := gostub.Stub(&envAliases, aliases)
+	defer stub.Reset()
+	env := []string{"NPU_DEVICES=1", "ASCEND_DEVICES=0"}
+	if value, err := getAscendValue(env, ascendVisibleDevices); err != nil || value != "0" {
+		t.Errorf("the first legacy name should be used, got %q, %v", value, err)
+	}
+	env = append(env, "ASCEND_VISIBLE_DEVICES=2")
+	if value, err := getAscendValue(env, ascendVisibleDevices); err != nil || value != "2" {
+		t.Errorf("the canonical name should take precedence, got %q, %v", value, err)
+	}
+
+	for _, invalid := range []string{"ASCEND_DEVICES\n", "ASCEND_DEVICES UNKNOWN\n",
+		"ASCEND_RUNTIME_MOUNTS ASCEND_VISIBLE_DEVICES\n", "OLD ASCEND_VISIBLE_DEVICES\nOLD ASCEND_RUNTIME_MOUNTS\n"} {
+		if err := os.WriteFile(file, []byte(invalid), 0600); err != nil {
+			t.Fatal("create file failed")
+		}
+		if _, err := loadEnvAliases(file); err == nil {
+			t.Errorf("%q should be invalid", invalid)
+		}
+	}
+}
+
+func TestCheckDriverVersionCase1(t *testing.T) {
+	hostDriver, oldDriver := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(hostDriver, "version.info"), []byte("Version=23.0.0\n"), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	if err := os.WriteFile(filepath.Join(oldDriver, "version.info"), []byte("Version=6.0.0\n"), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	stub := gostub.Stub(&ascendDriverPath, hostDriver)
+	defer stub.Reset()
+	stub.Stub(&ascendInstallInfoPath, "not-exist-install-info")
+	fileMounts := []mountEntry{{Path: filepath.Join(oldDriver, "version.info")}}
+	dirMounts := []mountEntry{{Path: hostDriver}, {Path: t.TempDir()}}
+
+	for mode, fail := range map[string]bool{versionCheckOff: false, versionCheckWarn: false, versionCheckError: true} {
+		stub.Stub(&driverVersionCheck, mode)
+		if err := checkDriverVersion(fileMounts, dirMounts); (err != nil) != fail {
+			t.Errorf("mode %s: unexpected error %v", mode, err)
+		}
+		if err := checkDriverVersion([]mountEntry{}, dirMounts); err != nil {
+			t.Errorf("mode %s: unexpected error %v", mode, err)
+		}
+	}
+}
+
+func TestReadMountConfigsCase1(t *testing.T) {
+	dir, err := os.MkdirTemp(".", "configs")
+	if err != nil {
+		t.Fatal("create dir failed")
+	}
+	defer os.RemoveAll(dir)
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		t.Fatal("get abs dir failed")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "base.list"), []byte(absDir+"\n"), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	_, dirList, err := readMountConfigs(dir, []string{"base", "?debug"}, nil)
+	if err != nil || len(dirList) != 1 {
+		t.Errorf("optional config should be skipped: %v", err)
+	}
+	if _, _, err := readMountConfigs(dir, []string{"base", "debug"}, nil); err == nil {
+		t.Fail()
+	}
+	// an optional config which exists but is invalid still fails
+	if err := os.WriteFile(filepath.Join(dir, "debug.list"), []byte("@UNKNOWN /usr\n"), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	if _, _, err := readMountConfigs(dir, []string{"base", "?debug"}, nil); err == nil {
+		t.Fail()
+	}
+	if configs, err := parseMounts("base,?Debug", true); err != nil || configs[1] != "?debug" {
+		t.Fail()
+	}
+	if _, err := parseMounts("base,?", true); err == nil {
+		t.Fail()
+	}
+}
+
+func TestReadMountConfigsCase2(t *testing.T) {
+	dir, err := os.MkdirTemp(".", "configs")
+	if err != nil {
+		t.Fatal("create dir failed")
+	}
+	defer os.RemoveAll(dir)
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		t.Fatal("get abs dir failed")
+	}
+	tools := filepath.Join(absDir, combinedConfigFile)
+	combined := "\n[base]\n" + absDir + "\n\n[tools]\n" + tools + "\n"
+	if err := os.WriteFile(filepath.Join(dir, combinedConfigFile), []byte(combined), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	fileList, dirList, err := readMountConfigs(dir, []string{"base", "tools", "?debug"}, nil)
+	if err != nil || len(dirList) != 1 || len(fileList) != 1 || fileList[0].Path != tools {
+		t.Errorf("unexpected mounts %v, %v, %v", fileList, dirList, err)
+	}
+	if _, _, err := readMountConfigs(dir, []string{"debug"}, nil); err == nil {
+		t.Error("unknown section should fail")
+	}
+	// the config file of its own takes precedence over the section
+	if err := os.WriteFile(filepath.Join(dir, "tools.list"), nil, 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	if fileList, _, err := readMountConfigs(dir, []string{"tools"}, nil); err != nil || len(fileList) != 0 {
+		t.Errorf("unexpected mounts %v, %v", fileList, err)
+	}
+
+	for _, invalid := range []string{"/usr\n[base]\n", "[base]\n[base]\n", "[Base]\n", "[../base]\n"} {
+		if err := os.WriteFile(filepath.Join(dir, combinedConfigFile), []byte(invalid), 0600); err != nil {
+			t.Fatal("create file failed")
+		}
+		if _, err := readCombinedConfig(filepath.Join(dir, combinedConfigFile)); err == nil {
+			t.Errorf("%q should be invalid", invalid)
+		}
+	}
+}
+
+func TestReadMountConfigsCase4(t *testing.T) {
+	dir, err := os.MkdirTemp(".", "configs")
+	if err != nil {
+		t.Fatal("create dir failed")
+	}
+	defer os.RemoveAll(dir)
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		t.Fatal("get abs dir failed")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "base.list"), []byte(absDir+"\n"), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	tools := filepath.Join(absDir, "base.list") + "\n" + filepath.Join(absDir, "tools.list") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "tools.list"), []byte(tools), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	fileMounts, dirMounts, err := readMountConfigs(dir, []string{"base", "tools"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &hookConfig{MountConfigs: []string{"base", "tools"}, FileMounts: fileMounts, DirMounts: dirMounts}
+	stub := gostub.Stub(&maxMounts, 3)
+	defer stub.Reset()
+	if err := checkMountsNumber(cfg); err != nil {
+		t.Errorf("3 mounts should be allowed: %v", err)
+	}
+	stub.Stub(&maxMounts, 2)
+	if err := checkMountsNumber(cfg); err == nil || !strings.Contains(err.Error(), "at most 2") {
+		t.Errorf("the total mounts should be capped: %v", err)
+	}
+}
+
+// TestResolveHookConfigCase5 tests the driver libraries added by -mount-driver-libs count in -max-mounts
+func TestResolveHookConfigCase5(t *testing.T) {
+	dir, err := os.MkdirTemp(".", "configs")
+	if err != nil {
+		t.Fatal("create dir failed")
+	}
+	defer os.RemoveAll(dir)
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		t.Fatal("get abs dir failed")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "base.list"), []byte(absDir+"/base.list\n"), 0600); err != nil {
+		t.Fatal("create file failed")
+	}
+	driverDir := t.TempDir()
+	libDir := filepath.Join(driverDir, driverLibDir)
+	if err := os.MkdirAll(libDir, 0700); err != nil {
+		t.Fatal("create dir failed")
+	}
+	for _, name := range []string{"libc_sec.so", "libdrvdsmi_host.so"} {
+		if err := os.WriteFile(filepath.Join(libDir, name), nil, 0600); err != nil {
+			t.Fatal("create file failed")
+		}
+	}
+	conCfg := containerConfig{Pid: pidSample, Rootfs: ".", Env: []string{"ASCEND_RUNTIME_MOUNTS=base"}}
+	stub := gostub.Stub(&mountConfigDir, absDir)
+	defer stub.Reset()
+	stub.Stub(&mountsOnly, true)
+	stub.Stub(&ascendInstallInfoPath, "not-exist-info")
+	stub.Stub(&ascendDriverPath, driverDir)
+	stub.Stub(&maxMounts, 2)
+	if _, err := resolveHookConfig(&conCfg); err != nil {
+		t.Errorf("1 mount should be allowed: %v", err)
+	}
+	stub.Stub(&mountDriverLibs, true)
+	if _, err := resolveHookConfig(&conCfg); err == nil || !strings.Contains(err.Error(), "driver libraries") {
+		t.Errorf("the driver libraries should be capped with the configs: %v", err)
+	}
+	stub.Stub(&maxMounts, 3)
+	if cfg, err := resolveHookConfig(&conCfg); err != nil || len(cfg.FileMounts) != 3 {
+		t.Errorf("3 mounts should be allowed: %v", err)
+	}
+}
+
+// TestGenerateMountConfigCase1 tests the suggested base.list lists the existing paths and comments out the others
+func TestGenerateMountConfigCase1(t *testing.T) {
+	driverDir, devDir := t.TempDir(), t.TempDir()
+	if err := os.Mkdir(filepath.Join(driverDir, driverLibDir), 0750); err != nil {
+		t.Fatalf("create lib dir failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(devDir, "davinci0"), nil, 0600); err != nil {
+		t.Fatalf("create device failed: %v", err)
+	}
+	stub := gostub.Stub(&ascendInstallInfoPath, "not-exist-info")
+	defer stub.Reset()
+	stub.Stub(&ascendDriverPath, driverDir)
+	stub.Stub(&hostDevPath, devDir)
+	stub.Stub(&deviceManagerNames, []string{})
+
+	var out bytes.Buffer
+	if err := generateMountConfig(&out); err != nil {
+		t.Fatalf("generate mount config failed: %v", err)
+	}
+	for _, want := range []string{
+		"\n" + filepath.Join(driverDir, driverLibDir) + "\n",
+		"# not found on this node: " + filepath.Join(driverDir, "include") + "\n",
+		"#   " + filepath.Join(devDir, "davinci0") + "\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output should contain %q, got %s", want, out.String())
+		}
+	}
+}
+
+// TestParseRuntimeOptionsCase1 tests the parameter of VIRTUAL is checked and kept in the option
+func TestParseRuntimeOptionsCase1(t *testing.T) {
+	options, err := parseRuntimeOptions("NODRV, VIRTUAL=vir04_3c_ndvpp")
+	if err != nil || len(options) != 2 || options[1] != "VIRTUAL=vir04_3c_ndvpp" {
+		t.Fatalf("unexpected options %v, err %v", options, err)
+	}
+	if !isConditionMet(mountEntry{Condition: "VIRTUAL"}, options) {
+		t.Errorf("@VIRTUAL should match the option with a parameter")
+	}
+	for _, invalid := range []string{"VIRTUAL=vir4", "VIRTUAL=vir04_3", "VIRTUAL=", "NODRV=vir04", "VIRTUAL=x04"} {
+		if _, err := parseRuntimeOptions(invalid); err == nil {
+			t.Errorf("%s should be rejected", invalid)
+		}
+	}
+}
+
+// TestDoPrestartHookCase7 tests the cause of a failure is kept in the error of the hook
+func TestDoPrestartHookCase7(t *testing.T) {
+	stub := gostub.StubFunc(&getContainerConfig, (*containerConfig)(nil), errors.New("bundle is not a directory"))
+	defer stub.Reset()
+	err := doPrestartHook()
+	if err == nil || !strings.Contains(err.Error(), "bundle is not a directory") {
+		t.Errorf("the cause should be in the error, got %v", err)
+	}
+}
+
+// TestResolveHookConfigCase4 tests a container without ascend configuration fails with -require-ascend
+func TestResolveHookConfigCase4(t *testing.T) {
+	conCfg := containerConfig{Pid: pidSample, Rootfs: ".", Env: []string{"PATH=/usr/bin"}}
+	if cfg, err := resolveHookConfig(&conCfg); err != nil || cfg.Enabled {
+		t.Error("the hook should do nothing for a container without ascend configuration")
+	}
+	stub := gostub.Stub(&requireAscend, true)
+	defer stub.Reset()
+	if _, err := resolveHookConfig(&conCfg); err == nil {
+		t.Error("the hook should fail with -require-ascend")
+	}
+	// disabling the hook is still honored
+	conCfg.Env = append(conCfg.Env, "ASCEND_HOOK_DISABLE=true")
+	if _, err := resolveHookConfig(&conCfg); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestResolveMountEntryCase2 tests the device nodes are only taken when they are marked as devices
+func TestResolveMountEntryCase2(t *testing.T) {
+	entry, err := parseMountEntry("/dev/null device")
+	if err != nil || !entry.Device || entry.Path != "/dev/null" {
+		t.Fatalf("unexpected entry %+v, %v", entry, err)
+	}
+	for _, line := range []string{"dev/null device", "/dev/null rslave device"} {
+		if _, err := parseMountEntry(line); err == nil {
+			t.Errorf("%q should be invalid", line)
+		}
+	}
+	if _, isDir, err := resolveMountEntry(entry); err != nil || isDir {
+		t.Errorf("the device should be taken, %v", err)
+	}
+	if _, _, err := resolveMountEntry(mountEntry{Path: "/dev/null"}); !errors.Is(err, errWrongType) {
+		t.Errorf("the device should be skipped without the mark, %v", err)
+	}
+	if _, _, err := resolveMountEntry(mountEntry{Path: t.TempDir(), Device: true}); !errors.Is(err, errWrongType) {
+		t.Errorf("a dir should not be taken as a device, %v", err)
+	}
+}
+
+// TestRunWithTimeoutCase1 tests a slow stage is reported when the setup times out
+func TestRunWithTimeoutCase1(t *testing.T) {
+	stub := gostub.Stub(&progress, &hookProgress{})
+	defer stub.Reset()
+	release := make(chan struct{})
+	defer close(release)
+	err := runWithTimeout(func() error {
+		startStage("mount")
+		progress.addResolved()
+		<-release
+		return nil
+	}, 10*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), `stage "mount" with 1 mount entries resolved`) {
+		t.Errorf("the timeout should tell the stage, got %v", err)
+	}
+	if err := runWithTimeout(func() error { return nil }, time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestRunWithTimeoutCase2 tests the trace is written while the setup left running after the timeout ends its stage
+func TestRunWithTimeoutCase2(t *testing.T) {
+	stub := gostub.Stub(&progress, &hookProgress{})
+	defer stub.Reset()
+	stub.Stub(&tracer, newHookTracer(""))
+	release, ended := make(chan struct{}), make(chan struct{})
+	err := runWithTimeout(func() error {
+		defer close(ended)
+		end := startStage("mount")
+		<-release
+		end(nil)
+		return nil
+	}, 10*time.Millisecond)
+	if err == nil {
+		t.Fatal("the setup should time out")
+	}
+	tracePath := filepath.Join(t.TempDir(), "trace.json")
+	close(release)
+	tracer.finish(tracePath, err)
+	<-ended
+	content, err := os.ReadFile(tracePath)
+	if err != nil || !strings.Contains(string(content), "setup timed out") {
+		t.Errorf("the trace should be written with the timeout, got %s, %v", content, err)
+	}
+}
+
+// TestRunWithTimeoutCase3 tests the panic of the setup is handled by recoverPanic with the stack of the setup
+func TestRunWithTimeoutCase3(t *testing.T) {
+	exitCode := -1
+	stub := gostub.Stub(&exitHook, func(code int) { exitCode = code })
+	defer stub.Reset()
+	var out bytes.Buffer
+	stub.Stub(&hookLog, &hookLogger{fallback: &out})
+	stub.Stub(&progress, &hookProgress{})
+	func() {
+		defer recoverPanic()
+		runWithTimeout(func() error {
+			_, _ = lookupValueByKey([]string{"NO_VALUE"}, "PATH")
+			return nil
+		}, time.Second)
+	}()
+	if exitCode != panicExitCode {
+		t.Errorf("the panic should exit with %d, got %d", panicExitCode, exitCode)
+	}
+	if !strings.Contains(out.String(), "environment error") || !strings.Contains(out.String(), "lookupValueByKey") {
+		t.Errorf("the panic should be logged with the stack of the setup, got %q", out.String())
+	}
+}
+
+// TestCheckContainerCwdCase1 tests a missing cwd is only warned unless the check is strict
+func TestCheckContainerCwdCase1(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.Mkdir(filepath.Join(rootfs, "workspace"), 0750); err != nil {
+		t.Fatal("create dir failed")
+	}
+	conCfg := &containerConfig{Rootfs: rootfs, Cwd: "/not-exist"}
+	// not checked by default
+	if err := checkContainerCwd(conCfg); err != nil {
+		t.Error(err)
+	}
+	stub := gostub.Stub(&cwdCheck, versionCheckWarn)
+	defer stub.Reset()
+	if err := checkContainerCwd(conCfg); err != nil {
+		t.Error(err)
+	}
+	stub.Stub(&cwdCheck, versionCheckError)
+	if err := checkContainerCwd(conCfg); err == nil {
+		t.Error("missing cwd should fail the strict check")
+	}
+	conCfg.Cwd = "/workspace"
+	if err := checkContainerCwd(conCfg); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCheckLogSpaceCase1 tests the run log falls back to the writer when the disk of the log is nearly full
+func TestCheckLogSpaceCase1(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkLogSpace(dir, 0); err != nil {
+		t.Error(err)
+	}
+	if err := checkLogSpace(dir, 1<<62); err == nil {
+		t.Error("no disk has so much space available")
+	}
+
+	var out bytes.Buffer
+	stub := gostub.Stub(&hookLog, &hookLogger{fallback: &out})
+	defer stub.Reset()
+	stub.Stub(&runLogLevel, infoLevel)
+	hookLog.Debugf("filtered %d", 1)
+	hookLog.Warnf("kept %d", 2)
+	if strings.Contains(out.String(), "filtered") || !strings.Contains(out.String(), "[WARN]") ||
+		!strings.Contains(out.String(), "kept 2") {
+		t.Errorf("unexpected fallback log %q", out.String())
+	}
+}
+
+// TestReadMountEntriesCase1 tests a mount config left with blank lines only is warned, while the entries skipped
+// for the runtime options still count
+func TestReadMountEntriesCase1(t *testing.T) {
+	var out bytes.Buffer
+	stub := gostub.Stub(&hookLog, &hookLogger{fallback: &out})
+	defer stub.Reset()
+	stub.Stub(&progress, &hookProgress{})
+	files, dirs, err := readMountEntries(strings.NewReader("\n\n"), "base.list", "base", nil,
+		map[string]mountEntry{})
+	if err != nil || len(files)+len(dirs) != 0 || !strings.Contains(out.String(), "base.list has no entry") {
+		t.Errorf("the empty config should be warned, got %q, %v", out.String(), err)
+	}
+	out.Reset()
+	if _, _, err := readMountEntries(strings.NewReader("@VIRTUAL /usr/local/dcmi\n"), "base.list", "base", nil,
+		map[string]mountEntry{}); err != nil || strings.Contains(out.String(), "has no entry") {
+		t.Errorf("the entry skipped for the options should count, got %q, %v", out.String(), err)
+	}
+}
+
+// TestReadMountEntriesCase2 tests the same path listed again with a different condition is warned and skipped
+func TestReadMountEntriesCase2(t *testing.T) {
+	var out bytes.Buffer
+	stub := gostub.Stub(&hookLog, &hookLogger{fallback: &out})
+	defer stub.Reset()
+	stub.Stub(&progress, &hookProgress{})
+	dir := t.TempDir()
+	content := "@VIRTUAL " + dir + " rslave\n" + dir + "\n" + dir + "\n"
+	_, dirs, err := readMountEntries(strings.NewReader(content), "base.list", "base", []string{"VIRTUAL"},
+		map[string]mountEntry{})
+	if err != nil || len(dirs) != 1 || dirs[0].Condition != "VIRTUAL" || dirs[0].Propagation != "rslave" {
+		t.Fatalf("the first entry should be mounted, got %+v, %v", dirs, err)
+	}
+	if strings.Count(out.String(), "reason="+skipDuplicated) != 2 ||
+		!strings.Contains(out.String(), "different from the first entry") {
+		t.Errorf("the conflicting entries should be warned, got %q", out.String())
+	}
+}
+
+// TestChooseConfigDirCase1 tests a container can only choose one of the allowed config dirs
+func TestChooseConfigDirCase1(t *testing.T) {
+	stub := gostub.Stub(&mountConfigDir, "/etc/ascend-docker-runtime.d")
+	defer stub.Reset()
+	dir, err := chooseConfigDir([]string{"PATH=/usr/bin"})
+	if err != nil || dir != mountConfigDir {
+		t.Errorf("the node's config dir should be used, got %s, %v", dir, err)
+	}
+	env := []string{ascendConfigDir + "=/etc/ascend-tenants/a/"}
+	if _, err := chooseConfigDir(env); err == nil {
+		t.Error("no config dir is allowed by default")
+	}
+	dirs, err := parseConfigDirs("/etc/ascend-tenants/a, /etc/ascend-tenants/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.Stub(&allowedConfigDirs, dirs)
+	if dir, err := chooseConfigDir(env); err != nil || dir != "/etc/ascend-tenants/a" {
+		t.Errorf("the allowed config dir should be used, got %s, %v", dir, err)
+	}
+	for _, chosen := range []string{"/etc/ascend-tenants", "/etc/ascend-tenants/a/../../../root"} {
+		if _, err := chooseConfigDir([]string{ascendConfigDir + "=" + chosen}); err == nil {
+			t.Errorf("%s should not be allowed", chosen)
+		}
+	}
+	if _, err := parseConfigDirs("relative/dir"); err == nil {
+		t.Error("relative dir should be rejected")
+	}
+}
+
+// TestSortOptionsCase1 tests the runtime options given in any order are sorted into the same order
+func TestSortOptionsCase1(t *testing.T) {
+	for _, given := range []string{"VIRTUAL=vir04,NODRV", "NODRV,VIRTUAL=vir04"} {
+		options, err := parseRuntimeOptions(given)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sortOptions(options)
+		if strings.Join(options, ",") != "NODRV,VIRTUAL=vir04" {
+			t.Errorf("unexpected order %v of %s", options, given)
+		}
+	}
+}
+
+// TestRecoverPanicCase1 tests a panic is recovered into its own exit code, or raised again for a core dump
+func TestRecoverPanicCase1(t *testing.T) {
+	exitCode := -1
+	stub := gostub.Stub(&exitHook, func(code int) { exitCode = code })
+	defer stub.Reset()
+	stub.Stub(&hookLog, &hookLogger{fallback: io.Discard})
+	func() {
+		defer recoverPanic()
+		panic("unexpected state")
+	}()
+	if exitCode != panicExitCode {
+		t.Errorf("the panic should exit with %d, got %d", panicExitCode, exitCode)
+	}
+
+	t.Setenv(ascendHookRepanic, "true")
+	defer func() {
+		if r := recover(); r != "unexpected state" {
+			t.Errorf("the panic should be raised again, got %v", r)
+		}
+	}()
+	func() {
+		defer recoverPanic()
+		panic("unexpected state")
+	}()
+	t.Error("the panic should not be swallowed")
+}
+
+// TestParseRuntimeOptionsCase2 tests the unknown runtime options are handled by the unknown options mode
+func TestParseRuntimeOptionsCase2(t *testing.T) {
+	if _, err := parseRuntimeOptions("NODRV,FUTURE"); err == nil {
+		t.Error("unknown option should fail in the strict mode")
+	}
+	stub := gostub.Stub(&unknownOptionsMode, unknownOptionsLenient)
+	defer stub.Reset()
+	if options, err := parseRuntimeOptions("NODRV,FUTURE"); err != nil || strings.Join(options, ",") != "NODRV" {
+		t.Errorf("unknown option should be dropped in the lenient mode, got %v, %v", options, err)
+	}
+	if _, err := parseRuntimeOptions("VIRTUAL=bad"); err == nil {
+		t.Error("invalid parameter of a known option should still fail")
+	}
+	stub.Stub(&unknownOptionsMode, unknownOptionsPassthrough)
+	options, err := parseRuntimeOptions("NODRV,FUTURE=1")
+	if err != nil || strings.Join(options, ",") != "NODRV,FUTURE=1" {
+		t.Errorf("unknown option should be kept in the passthrough mode, got %v, %v", options, err)
+	}
+	if _, err := parseRuntimeOptions("NODRV,a;b"); err == nil {
+		t.Error("illegal characters should still fail in the passthrough mode")
+	}
+}
+
+// TestParseFlagsCase2 tests the comma separated values are accepted and the illegal characters in values rejected
+func TestParseFlagsCase2(t *testing.T) {
+	stub := gostub.Stub(&deviceManagerNames, deviceManagerNames)
+	defer stub.Reset()
+	stub.Stub(&allowedEnvNames, allowedEnvNames)
+	stub.Stub(&deviceMajors, deviceMajors)
+	stub.Stub(&allowedConfigDirs, allowedConfigDirs)
+	stub.Stub(&mountConfigDir, mountConfigDir)
+	stub.Stub(&stateFilePath, "")
+	stub.Stub(&flagOutput, io.Discard)
+	args := []string{"-device-managers", "davinci_manager,devmm_svm",
+		"-env-allowlist=ASCEND_VISIBLE_DEVICES,ASCEND_RUNTIME_MOUNTS", "-device-majors", "236,237",
+		"-allowed-config-dirs", "/etc/ascend-tenants/a,/etc/ascend-tenants/b"}
+	if err := parseFlags(args); err != nil {
+		t.Fatalf("parse flags failed: %v", err)
+	}
+	if len(deviceManagerNames) != 2 || len(allowedEnvNames) != 2 || len(deviceMajors) != 2 ||
+		len(allowedConfigDirs) != 2 {
+		t.Errorf("unexpected lists %v %v %v %v", deviceManagerNames, allowedEnvNames, deviceMajors, allowedConfigDirs)
+	}
+	if err := parseFlags([]string{"-config-dir", "/etc/ascend;reboot"}); err == nil {
+		t.Error("illegal characters in a value should be rejected")
+	}
+}
+
+// TestBindMountCase1 tests the bind error is returned and the propagation is changed by a second mount
+// on the target opened again
+func TestBindMountCase1(t *testing.T) {
+	rootfs := t.TempDir()
+	dest := filepath.Join(rootfs, "driver")
+	if err := os.Mkdir(dest, 0750); err != nil {
+		t.Fatal("create dir failed")
+	}
+	type mountCall struct {
+		source string
+		flags  uintptr
+	}
+	calls := make([]mountCall, 0)
+	stub := gostub.Stub(&doMount, func(source string, target string, fstype string, flags uintptr, data string) error {
+		if !strings.HasPrefix(target, "/proc/self/fd/") {
+			t.Errorf("the target should be the procfd, got %s", target)
+		}
+		calls = append(calls, mountCall{source, flags})
+		return nil
+	})
+	defer stub.Reset()
+	if err := bindMount(rootfs, dest, "/usr/local/Ascend/driver", "rslave"); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2 || calls[0].flags != unix.MS_BIND || calls[0].source != "/usr/local/Ascend/driver" ||
+		calls[1].flags != mountPropagations["rslave"] || calls[1].source != "" {
+		t.Errorf("unexpected mounts %+v", calls)
+	}
+
+	calls = calls[:0]
+	stub.Stub(&doMount, func(string, string, string, uintptr, string) error {
+		calls = append(calls, mountCall{})
+		return syscall.EPERM
+	})
+	if err := bindMount(rootfs, dest, "/usr/local/Ascend/driver", "rslave"); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("the bind error should be returned, got %v", err)
+	}
+	if len(calls) != 1 {
+		t.Errorf("the propagation should not be changed after a failed bind, got %d mounts", len(calls))
+	}
+	// the bind failure is fatal without the propagation as well
+	if err := bindMount(rootfs, dest, "/usr/local/Ascend/driver", ""); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("the bind error should be returned without the propagation, got %v", err)
+	}
+	if err := bindMount(rootfs, dest, "/usr/local/Ascend/driver", "bogus"); err == nil {
+		t.Error("unknown propagation should fail before mounting")
+	}
+}